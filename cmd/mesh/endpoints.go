@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/url"
+
+	c "github.com/RiV-chain/RiV-mesh/src/config"
+)
+
+// Returns the host names and addresses of the configured peers, so that exit
+// client mode can keep the connections to them out of the tunnel before they
+// are established. The TUN adapter resolves host names itself, and keeps them
+// up to date.
+func peerHosts(cfg *c.NodeConfig) []string {
+	uris := append([]string(nil), cfg.Peers...)
+	for _, peers := range cfg.InterfacePeers {
+		uris = append(uris, peers...)
+	}
+	var hosts []string
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Asks the running node at the given REST address how packets to and from
+// the given IP address are handled, and prints the answer. This is used with
+// -lookup.
+func doLookup(httpaddress, address, key string) error {
+	u, err := url.Parse(strings.TrimSuffix(httpaddress, "/") + "/api/tunnelrouting/lookup/" + url.PathEscape(address))
+	if err != nil {
+		return fmt.Errorf("url.Parse: %w", err)
+	}
+	if key != "" {
+		u.RawQuery = url.Values{"key": {key}}.Encode()
+	}
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("http.Get: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return fmt.Errorf("json.Indent: %w", err)
+	}
+	fmt.Println(out.String())
+	return nil
+}
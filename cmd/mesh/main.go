@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"regexp"
@@ -41,6 +42,7 @@ import (
 type node struct {
 	core        *core.Core
 	tun         *tun.TunAdapter
+	rwc         *ckriprwc.ReadWriteCloser
 	multicast   *multicast.Multicast
 	rest_server *api.RestServer
 }
@@ -156,6 +158,8 @@ type rivArgs struct {
 	loglevel      string
 	httpaddress   string
 	wwwroot       string
+	lookup        string
+	lookupkey     string
 }
 
 func getArgs() rivArgs {
@@ -172,6 +176,8 @@ func getArgs() rivArgs {
 	loglevel := flag.String("loglevel", "info", "loglevel to enable")
 	httpaddress := flag.String("httpaddress", "", "httpaddress to enable")
 	wwwroot := flag.String("wwwroot", "", "wwwroot to enable")
+	lookup := flag.String("lookup", "", "asks the running node how packets to and from the given IP address are handled")
+	lookupkey := flag.String("lookupkey", "", "use in combination with -lookup, checks whether packets from the address are accepted from the given public key")
 
 	flag.Parse()
 	return rivArgs{
@@ -188,6 +194,8 @@ func getArgs() rivArgs {
 		loglevel:      *loglevel,
 		httpaddress:   *httpaddress,
 		wwwroot:       *wwwroot,
+		lookup:        *lookup,
+		lookupkey:     *lookupkey,
 	}
 }
 
@@ -221,6 +229,20 @@ func run(args rivArgs, sigCh chan os.Signal) {
 	var cfg *c.NodeConfig
 	var err error
 	switch {
+	case args.lookup != "":
+		// Ask the running node over the REST API, which is found from
+		// -httpaddress or from the configuration if one was given
+		httpaddress := args.httpaddress
+		if httpaddress == "" && (args.useconffile != "" || args.useconf) {
+			httpaddress = readConfig(logger, args.useconf, args.useconffile, false).HttpAddress
+		}
+		if httpaddress == "" {
+			httpaddress = defaults.Define().DefaultHttpAddress
+		}
+		if err := doLookup(httpaddress, args.lookup, args.lookupkey); err != nil {
+			fmt.Println("Lookup failed:", err)
+		}
+		return
 	case args.ver:
 		fmt.Println("Build name:", version.BuildName())
 		fmt.Println("Build version:", version.BuildVersion())
@@ -345,6 +367,62 @@ func run(args rivArgs, sigCh chan os.Signal) {
 		}
 	}
 
+	// Setup the crypto-key routing packet layer.
+	var node_config *config.TunnelRoutingConfig
+	{
+		node_config = &config.TunnelRoutingConfig{
+			Enable:            false,
+			IPv4RemoteSubnets: nil,
+			IPv6RemoteSubnets: nil,
+		}
+		mapstructure.Decode(cfg.FeaturesConfig["TunnelRouting"], node_config)
+		n.rwc = ckriprwc.NewReadWriteCloser(n.core, node_config, logger)
+	}
+
+	// Setup the TUN module.
+	{
+		options := []tun.SetupOption{
+			tun.InterfaceName(cfg.IfName),
+			tun.InterfaceMTU(cfg.IfMTU),
+			tun.RouteTable(node_config.RouteTable),
+			tun.RouteMetric(node_config.RouteMetric),
+			tun.RouteProtocol(node_config.RouteProtocol),
+		}
+		for _, r := range node_config.RoutingRules {
+			rule := tun.RoutingRule{Mark: r.Mark, Mask: r.Mask, Priority: r.Priority}
+			if r.Source != "" {
+				if rule.Source, err = netip.ParsePrefix(r.Source); err != nil {
+					panic(fmt.Errorf("Error parsing routing rule source %q: %w", r.Source, err))
+				}
+			}
+			options = append(options, rule)
+		}
+		if node_config.ExitClient || node_config.KillSwitch {
+			for _, host := range peerHosts(cfg) {
+				options = append(options, tun.PeerEndpoint(host))
+			}
+		}
+		if node_config.ExitClient {
+			options = append(options, tun.ExitClient(true))
+		}
+		if node_config.ExitServer {
+			options = append(options, tun.ExitServer(true))
+		}
+		if node_config.KillSwitch {
+			options = append(options, tun.KillSwitch(true))
+			for _, allow := range node_config.KillSwitchAllow {
+				prefix, err := netip.ParsePrefix(allow)
+				if err != nil {
+					panic(fmt.Errorf("Error parsing kill switch exception %q: %w", allow, err))
+				}
+				options = append(options, tun.KillSwitchAllow(prefix))
+			}
+		}
+		if n.tun, err = tun.New(n.core, n.rwc, logger, options...); err != nil {
+			panic(err)
+		}
+	}
+
 	// Setup the REST socket.
 	{
 		//override httpaddress and wwwroot parameters in cfg
@@ -366,7 +444,7 @@ func run(args rivArgs, sigCh chan os.Signal) {
 		if n.rest_server, err = api.NewRestServer(options); err != nil {
 			logger.Errorln(err)
 		} else {
-			if rest_server, err := r.NewRestServer(n.rest_server, cfg); err != nil {
+			if rest_server, err := r.NewRestServer(n.rest_server, cfg, n.rwc, n.tun); err != nil {
 				logger.Errorln(err)
 			} else {
 				err = rest_server.Serve()
@@ -377,26 +455,6 @@ func run(args rivArgs, sigCh chan os.Signal) {
 		}
 	}
 
-	// Setup the TUN module.
-	{
-		options := []tun.SetupOption{
-			tun.InterfaceName(cfg.IfName),
-			tun.InterfaceMTU(cfg.IfMTU),
-		}
-
-		var node_config = &config.TunnelRoutingConfig{
-			Enable:            false,
-			IPv4RemoteSubnets: nil,
-			IPv6RemoteSubnets: nil,
-		}
-		mapstructure.Decode(cfg.FeaturesConfig["TunnelRouting"], node_config)
-		// TODO: refactor this!
-		rwc := ckriprwc.NewReadWriteCloser(n.core, node_config, logger)
-		if n.tun, err = tun.New(n.core, rwc, logger, options...); err != nil {
-			panic(err)
-		}
-	}
-
 	// Make some nice output that tells us what our IPv6 address and subnet are.
 	// This is just logged to stdout for the user.
 	address := n.core.Address()
@@ -0,0 +1,262 @@
+package ckriprwc
+
+// The advertise module lets CKR nodes learn routes from each other instead of
+// both sides having to configure matching remote subnets. A node which has
+// AdvertiseRoutes enabled answers route solicitations with a list of its local
+// subnets, signed with its ed25519 key. Nodes which trust that announcer
+// solicit it periodically and install the advertised prefixes as routes with a
+// limited lifetime, withdrawing them once they have not been refreshed in
+// time. Manually configured routes always take precedence over learned ones.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+const (
+	advertInterval    = time.Minute        // How often trusted announcers are solicited
+	advertLifetime    = 3 * advertInterval // How long advertised routes are valid for
+	maxAdvertLifetime = time.Hour          // Upper bound on the lifetime accepted from an announcer
+	maxAdvertPrefixes = 64                 // Keeps an advertisement within a single packet
+)
+
+// The route advertisement settings, replaced whenever the configuration is.
+type advertConfig struct {
+	advertise bool
+	trusted   map[keyArray]bool
+}
+
+// The prefixes learned from a single announcer.
+type announcement struct {
+	seq      uint64 // Sequence number of the last accepted advertisement
+	expires  time.Time
+	prefixes []netip.Prefix
+}
+
+// Parses the route advertisement settings from the given configuration.
+func parseAdverts(cfg *config.TunnelRoutingConfig) (*advertConfig, error) {
+	adverts := &advertConfig{
+		advertise: cfg.AdvertiseRoutes,
+		trusted:   make(map[keyArray]bool, len(cfg.TrustedAnnouncers)),
+	}
+	for _, announcer := range cfg.TrustedAnnouncers {
+		bpk, err := hex.DecodeString(announcer)
+		if err != nil || len(bpk) != ed25519.PublicKeySize {
+			return nil, errors.New("Error adding trusted announcer: invalid public key " + announcer)
+		}
+		var key keyArray
+		copy(key[:], bpk)
+		adverts.trusted[key] = true
+	}
+	return adverts, nil
+}
+
+// Returns the current route advertisement settings.
+func (c *cryptokey) advertSettings() *advertConfig {
+	return c.snapshot().adverts
+}
+
+// Returns the prefixes that this node advertises, which are its local subnets.
+func (c *cryptokey) advertisedPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range c.snapshot().sources.subnets.all() {
+		prefixes = append(prefixes, r.Prefix)
+	}
+	if len(prefixes) > maxAdvertPrefixes {
+		c.log.Warnf("Only advertising %d of %d local subnets", maxAdvertPrefixes, len(prefixes))
+		prefixes = prefixes[:maxAdvertPrefixes]
+	}
+	return prefixes
+}
+
+// Records the prefixes advertised by the given announcer, replacing any that
+// it advertised before. Advertisements which are not newer than the last one
+// accepted from the announcer are ignored.
+func (c *cryptokey) learnRoutes(announcer ed25519.PublicKey, seq uint64, lifetime time.Duration, prefixes []netip.Prefix) {
+	var key keyArray
+	copy(key[:], announcer)
+	if !c.isEnabled() || !c.advertSettings().trusted[key] {
+		return
+	}
+	if lifetime > maxAdvertLifetime {
+		lifetime = maxAdvertLifetime
+	}
+	c.updateDynamic(func() {
+		if old := c.learned[key]; old != nil && seq <= old.seq {
+			return
+		}
+		if c.learned == nil {
+			c.learned = make(map[keyArray]*announcement)
+		}
+		c.learned[key] = &announcement{
+			seq:      seq,
+			expires:  time.Now().Add(lifetime),
+			prefixes: prefixes,
+		}
+	})
+}
+
+// Withdraws the routes of announcers which have not refreshed them in time.
+// The announcement itself is kept so that older advertisements from the same
+// announcer are still rejected.
+func (c *cryptokey) expireLearned() {
+	now := time.Now()
+	c.updateDynamic(func() {
+		for key, a := range c.learned {
+			if a.prefixes != nil && now.After(a.expires) {
+				c.log.Infoln("Routes advertised by", hex.EncodeToString(key[:]), "have expired")
+				a.prefixes = nil
+			}
+		}
+	})
+}
+
+// Returns the routes to install for the learned prefixes. A prefix advertised
+// by several announcers is routed to all of them with equal priority. The
+// caller must hold c.mutex.
+func (c *cryptokey) _learnedRoutes() map[netip.Prefix]*route {
+	keys := make([]keyArray, 0, len(c.learned))
+	for key := range c.learned {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	routes := make(map[netip.Prefix]*route)
+	for _, key := range keys {
+		for _, prefix := range c.learned[key].prefixes {
+			g, _ := newGateway(key[:], 0)
+			if r := routes[prefix]; r != nil {
+				r.gateways = append(r.gateways, g)
+				continue
+			}
+			r, err := c.newRoute(prefix, g)
+			if err != nil {
+				c.log.Debugln("Ignoring advertised subnet", prefix, "from", hex.EncodeToString(key[:]), ":", err)
+				continue
+			}
+			r.origin = RouteAdvertised
+			routes[prefix] = r
+		}
+	}
+	return routes
+}
+
+// Returns a table based on the given one in which the learned routes match the
+// currently learned prefixes. Learned routes are never installed over routes
+// from anywhere else. If nothing needs to change then the given table is
+// returned. The caller must hold c.mutex.
+func (c *cryptokey) _withLearned(table *routeTable) *routeTable {
+	learned := c._learnedRoutes()
+	result := table
+	for _, r := range table.all() {
+		if r.origin != RouteAdvertised {
+			continue
+		}
+		if nr := learned[r.Prefix]; nr == nil || !nr.sameGateways(r) {
+			result, _ = result.withoutRoute(r.Prefix)
+		}
+	}
+	for prefix, r := range learned {
+		if result.get(prefix) == nil {
+			result = result.withReplacedRoute(r)
+		}
+	}
+	return result
+}
+
+// Encodes a route advertisement, without the packet type or signature.
+func encodeRouteAdvert(seq uint64, lifetime time.Duration, prefixes []netip.Prefix) []byte {
+	bs := make([]byte, 13, 13+len(prefixes)*18)
+	binary.BigEndian.PutUint64(bs[0:8], seq)
+	binary.BigEndian.PutUint32(bs[8:12], uint32(lifetime/time.Second))
+	bs[12] = byte(len(prefixes))
+	for _, prefix := range prefixes {
+		addr := prefix.Addr().AsSlice()
+		bs = append(bs, byte(len(addr)), byte(prefix.Bits()))
+		bs = append(bs, addr...)
+	}
+	return bs
+}
+
+// Decodes a route advertisement produced by encodeRouteAdvert.
+func decodeRouteAdvert(bs []byte) (seq uint64, lifetime time.Duration, prefixes []netip.Prefix, err error) {
+	if len(bs) < 13 {
+		return 0, 0, nil, errors.New("route advertisement too short")
+	}
+	seq = binary.BigEndian.Uint64(bs[0:8])
+	lifetime = time.Duration(binary.BigEndian.Uint32(bs[8:12])) * time.Second
+	count := int(bs[12])
+	bs = bs[13:]
+	for i := 0; i < count; i++ {
+		if len(bs) < 2 || (bs[0] != 4 && bs[0] != 16) || len(bs) < 2+int(bs[0]) {
+			return 0, 0, nil, errors.New("malformed route advertisement")
+		}
+		addr, _ := netip.AddrFromSlice(bs[2 : 2+int(bs[0])])
+		prefix := netip.PrefixFrom(addr, int(bs[1]))
+		if !prefix.IsValid() {
+			return 0, 0, nil, errors.New("invalid prefix in route advertisement")
+		}
+		prefixes = append(prefixes, prefix.Masked())
+		bs = bs[2+int(bs[0]):]
+	}
+	if len(bs) != 0 {
+		return 0, 0, nil, errors.New("trailing data in route advertisement")
+	}
+	return seq, lifetime, prefixes, nil
+}
+
+// Handles a route solicitation, answering it with our local subnets if route
+// advertisement is enabled.
+func (k *keyStore) handleRouteSolicit(fromKey, toKey ed25519.PublicKey, sig []byte) {
+	if !k.ckr.advertSettings().advertise || !toKey.Equal(k.core.PublicKey()) {
+		return
+	}
+	if !ed25519.Verify(fromKey, toKey[:], sig) {
+		return
+	}
+	payload := append([]byte{typeRouteAdvert}, encodeRouteAdvert(uint64(time.Now().UnixNano()), advertLifetime, k.ckr.advertisedPrefixes())...)
+	// The signature covers the recipient's key so that the advertisement
+	// can't be replayed to other nodes
+	msg := append(append([]byte(nil), fromKey...), payload...)
+	_ = k.core.SendOutOfBand(fromKey, append(payload, ed25519.Sign(k.core.PrivateKey(), msg)...))
+}
+
+// Handles a route advertisement, installing the advertised routes if the
+// announcer is trusted and the signature is valid.
+func (k *keyStore) handleRouteAdvert(fromKey ed25519.PublicKey, data []byte) {
+	if len(data) < 1+ed25519.SignatureSize {
+		return
+	}
+	payload, sig := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+	msg := append(append([]byte(nil), k.core.PublicKey()...), payload...)
+	if !ed25519.Verify(fromKey, msg, sig) {
+		return
+	}
+	seq, lifetime, prefixes, err := decodeRouteAdvert(payload[1:])
+	if err != nil {
+		k.log.Debugln("Ignoring route advertisement from", hex.EncodeToString(fromKey), ":", err)
+		return
+	}
+	k.ckr.learnRoutes(fromKey, seq, lifetime, prefixes)
+}
+
+// Solicits route advertisements from all of the trusted announcers.
+func (k *keyStore) solicitRoutes() {
+	if !k.ckr.isEnabled() {
+		return
+	}
+	for key := range k.ckr.advertSettings().trusted {
+		dest := ed25519.PublicKey(append([]byte(nil), key[:]...))
+		sig := ed25519.Sign(k.core.PrivateKey(), dest)
+		_ = k.core.SendOutOfBand(dest, append([]byte{typeRouteSolicit}, sig...))
+	}
+}
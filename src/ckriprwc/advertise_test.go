@@ -0,0 +1,38 @@
+package ckriprwc
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRouteAdvertEncoding(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("fd00:1::/32"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	}
+	bs := encodeRouteAdvert(42, advertLifetime, prefixes)
+	seq, lifetime, decoded, err := decodeRouteAdvert(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 42 || lifetime != advertLifetime {
+		t.Errorf("Decoded sequence %d and lifetime %s", seq, lifetime)
+	}
+	if len(decoded) != len(prefixes) {
+		t.Fatalf("Decoded %d prefixes, expected %d", len(decoded), len(prefixes))
+	}
+	for i := range prefixes {
+		if decoded[i] != prefixes[i] {
+			t.Errorf("Decoded %s, expected %s", decoded[i], prefixes[i])
+		}
+	}
+	for n := 0; n < len(bs); n++ {
+		if _, _, _, err := decodeRouteAdvert(bs[:n]); err == nil {
+			t.Errorf("Expected truncated advertisement of %d bytes to be rejected", n)
+		}
+	}
+	if _, _, _, err := decodeRouteAdvert(append(bs, 0)); err == nil {
+		t.Error("Expected trailing data to be rejected")
+	}
+}
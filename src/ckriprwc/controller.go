@@ -0,0 +1,393 @@
+package ckriprwc
+
+// The controller module distributes crypto-key routing tables from a central
+// route controller. An administrator key signs a versioned table, either one
+// for all nodes or one for an individual node, and the controller serves the
+// signed tables over the out-of-band channel. Nodes which trust the
+// administrator key fetch the table from the controller in chunks, verify it
+// and apply it atomically if its version is newer than the one they have. The
+// last table applied is kept on disk so that it can be used straight away on
+// the next start, before the controller can be reached.
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+const (
+	controllerInterval = 5 * time.Minute // How often the controller nodes are asked for a newer table
+	tableChunkSize     = 1024            // How much of a table is sent in each out-of-band packet
+	maxTableChunks     = 256             // Upper bound on the size of a table
+)
+
+// A routing table signed by the administrator key. Tables for an individual
+// node name that node, so that they can't be passed off as another node's.
+type signedTable struct {
+	Version uint64
+	Node    string `json:",omitempty"`
+	Table   config.ControllerTable
+}
+
+// The route controller settings, replaced whenever the configuration is.
+type controllerConfig struct {
+	key     ed25519.PublicKey // The trusted administrator key, or nil
+	nodes   map[keyArray]bool // The nodes which tables are fetched from
+	cache   string
+	version uint64              // The version of the tables we serve
+	table   []byte              // The signed table served to all nodes, if we are a controller
+	tables  map[keyArray][]byte // The signed tables served to individual nodes
+}
+
+// The routing table currently applied from a route controller.
+type controlledTable struct {
+	key     ed25519.PublicKey // The administrator key which signed the table
+	version uint64
+	routes  map[netip.Prefix]*route
+}
+
+// A routing table being fetched from a controller node.
+type tableFetch struct {
+	version uint64
+	total   uint16
+	next    uint16
+	data    []byte
+}
+
+// Parses the route controller settings from the given configuration, signing
+// the tables that we serve if we are a route controller.
+func (c *cryptokey) parseController(cfg *config.TunnelRoutingConfig) (*controllerConfig, error) {
+	settings := &controllerConfig{
+		nodes: make(map[keyArray]bool, len(cfg.ControllerNodes)),
+		cache: cfg.ControllerCache,
+	}
+	if cfg.ControllerKey != "" {
+		key, err := hex.DecodeString(cfg.ControllerKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("Error setting controller key: invalid public key " + cfg.ControllerKey)
+		}
+		settings.key = key
+	}
+	for _, node := range cfg.ControllerNodes {
+		key, err := hex.DecodeString(node)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("Error adding controller node: invalid public key " + node)
+		}
+		var k keyArray
+		copy(k[:], key)
+		settings.nodes[k] = true
+	}
+	if cfg.RouteController != nil {
+		if err := c.signTables(settings, cfg.RouteController); err != nil {
+			return nil, fmt.Errorf("Error configuring route controller: %w", err)
+		}
+	}
+	return settings, nil
+}
+
+// Returns the current route controller settings.
+func (c *cryptokey) controllerSettings() *controllerConfig {
+	return c.snapshot().controller
+}
+
+// Signs the tables that we serve as a route controller, after checking that
+// they are valid.
+func (c *cryptokey) signTables(settings *controllerConfig, cfg *config.RouteControllerConfig) error {
+	priv, err := hex.DecodeString(cfg.PrivateKey)
+	if err != nil || len(priv) != ed25519.PrivateKeySize {
+		return errors.New("invalid private key")
+	}
+	sign := func(node string, table config.ControllerTable) ([]byte, error) {
+		if _, err := c.parseControllerTable(&table); err != nil {
+			return nil, err
+		}
+		bs, err := json.Marshal(&signedTable{
+			Version: cfg.Version,
+			Node:    node,
+			Table:   table,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("json.Marshal: %w", err)
+		}
+		if len(bs)+ed25519.SignatureSize > tableChunkSize*maxTableChunks {
+			return nil, errors.New("table is too large")
+		}
+		return append(ed25519.Sign(ed25519.PrivateKey(priv), bs), bs...), nil
+	}
+	settings.version = cfg.Version
+	if settings.table, err = sign("", cfg.Table); err != nil {
+		return err
+	}
+	settings.tables = make(map[keyArray][]byte, len(cfg.NodeTables))
+	for node, table := range cfg.NodeTables {
+		key, err := hex.DecodeString(node)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid public key " + node)
+		}
+		var k keyArray
+		copy(k[:], key)
+		if settings.tables[k], err = sign(hex.EncodeToString(key), table); err != nil {
+			return fmt.Errorf("table for %s: %w", node, err)
+		}
+	}
+	return nil
+}
+
+// Verifies the given signed table against the administrator key, and checks
+// that it is meant for the given node.
+func openTable(admin, node ed25519.PublicKey, signed []byte) (*signedTable, error) {
+	if len(signed) < ed25519.SignatureSize {
+		return nil, errors.New("signed table is too short")
+	}
+	sig, bs := signed[:ed25519.SignatureSize], signed[ed25519.SignatureSize:]
+	if !ed25519.Verify(admin, bs, sig) {
+		return nil, errors.New("invalid signature on routing table")
+	}
+	var table signedTable
+	if err := json.Unmarshal(bs, &table); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if table.Node != "" && table.Node != hex.EncodeToString(node) {
+		return nil, errors.New("routing table is for another node")
+	}
+	return &table, nil
+}
+
+// Parses the routes of a table distributed by a route controller.
+func (c *cryptokey) parseControllerTable(table *config.ControllerTable) (map[netip.Prefix]*route, error) {
+	routes, err := c.parseRoutes(&config.TunnelRoutingConfig{
+		IPv6RemoteSubnets:  table.IPv6RemoteSubnets,
+		IPv4RemoteSubnets:  table.IPv4RemoteSubnets,
+		IPv6RemoteGateways: table.IPv6RemoteGateways,
+		IPv4RemoteGateways: table.IPv4RemoteGateways,
+	})
+	if err != nil {
+		return nil, err
+	}
+	byPrefix := make(map[netip.Prefix]*route, len(routes))
+	for _, r := range routes {
+		r.origin = RouteControlled
+		byPrefix[r.Prefix] = r
+	}
+	return byPrefix, nil
+}
+
+// Returns the version of the table currently applied from a route controller.
+func (c *cryptokey) controlledVersion() (uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.controlled == nil {
+		return 0, false
+	}
+	return c.controlled.version, true
+}
+
+// Verifies and applies the given signed table if it is newer than the table
+// currently applied. Returns whether the table was applied.
+func (c *cryptokey) applyTable(signed []byte) (bool, error) {
+	settings := c.controllerSettings()
+	if settings.key == nil {
+		return false, errors.New("no controller key configured")
+	}
+	table, err := openTable(settings.key, c.core.PublicKey(), signed)
+	if err != nil {
+		return false, err
+	}
+	routes, err := c.parseControllerTable(&table.Table)
+	if err != nil {
+		return false, err
+	}
+	var applied bool
+	c.updateDynamic(func() {
+		if c.controlled != nil && table.Version <= c.controlled.version {
+			return
+		}
+		c.controlled = &controlledTable{
+			key:     settings.key,
+			version: table.Version,
+			routes:  routes,
+		}
+		applied = true
+	})
+	if applied {
+		c.log.Infoln("Applied routing table version", table.Version, "from the route controller")
+	}
+	return applied, nil
+}
+
+// Applies the routing table kept in the given file, if there is one.
+func (c *cryptokey) loadCachedTable(path string) {
+	signed, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.log.Warnln("Failed to read cached routing table:", err)
+		}
+		return
+	}
+	if _, err := c.applyTable(signed); err != nil {
+		c.log.Warnln("Failed to apply cached routing table:", err)
+	}
+}
+
+// Keeps the given signed table in the given file, replacing it atomically.
+func (c *cryptokey) saveCachedTable(path string, signed []byte) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err == nil {
+		_, err = tmp.Write(signed)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		c.log.Warnln("Failed to save cached routing table:", err)
+	}
+}
+
+// Returns a table based on the given one in which the controlled routes match
+// the table currently applied from a route controller. Controlled routes are
+// installed over advertised routes but never over locally configured ones. If
+// nothing needs to change then the given table is returned. The caller must
+// hold c.mutex.
+func (c *cryptokey) _withControlled(table *routeTable) *routeTable {
+	var controlled map[netip.Prefix]*route
+	if c.controlled != nil {
+		controlled = c.controlled.routes
+	}
+	result := table
+	for _, r := range table.all() {
+		if r.origin != RouteControlled {
+			continue
+		}
+		if nr := controlled[r.Prefix]; nr == nil || !nr.sameGateways(r) {
+			result, _ = result.withoutRoute(r.Prefix)
+		}
+	}
+	for prefix, r := range controlled {
+		if old := result.get(prefix); old == nil || old.origin > RouteControlled {
+			result = result.withReplacedRoute(r)
+		}
+	}
+	return result
+}
+
+// Handles a request for part of the routing table we serve, if we are a route
+// controller.
+func (k *keyStore) handleTableRequest(fromKey, toKey ed25519.PublicKey, data []byte) {
+	settings := k.ckr.controllerSettings()
+	if settings.table == nil || !toKey.Equal(k.core.PublicKey()) || len(data) != 2+ed25519.SignatureSize {
+		return
+	}
+	msg := append(append([]byte(nil), toKey...), data[:2]...)
+	if !ed25519.Verify(fromKey, msg, data[2:]) {
+		return
+	}
+	var from keyArray
+	copy(from[:], fromKey)
+	signed := settings.table
+	if table, ok := settings.tables[from]; ok {
+		signed = table
+	}
+	index := int(binary.BigEndian.Uint16(data[:2]))
+	total := (len(signed) + tableChunkSize - 1) / tableChunkSize
+	if index >= total {
+		return
+	}
+	end := (index + 1) * tableChunkSize
+	if end > len(signed) {
+		end = len(signed)
+	}
+	bs := make([]byte, 13, 13+end-index*tableChunkSize)
+	bs[0] = typeTableChunk
+	binary.BigEndian.PutUint64(bs[1:9], settings.version)
+	binary.BigEndian.PutUint16(bs[9:11], uint16(index))
+	binary.BigEndian.PutUint16(bs[11:13], uint16(total))
+	bs = append(bs, signed[index*tableChunkSize:end]...)
+	_ = k.core.SendOutOfBand(fromKey, bs)
+}
+
+// Handles part of a routing table from a controller node, requesting the next
+// part until the table is complete and then applying it.
+func (k *keyStore) handleTableChunk(fromKey ed25519.PublicKey, data []byte) {
+	settings := k.ckr.controllerSettings()
+	var from keyArray
+	copy(from[:], fromKey)
+	if settings.key == nil || !settings.nodes[from] || len(data) < 12 {
+		return
+	}
+	version := binary.BigEndian.Uint64(data[0:8])
+	index := binary.BigEndian.Uint16(data[8:10])
+	total := binary.BigEndian.Uint16(data[10:12])
+	chunk := data[12:]
+	if total == 0 || total > maxTableChunks || index >= total || len(chunk) > tableChunkSize {
+		return
+	}
+	current, ok := k.ckr.controlledVersion()
+	k.mutex.Lock()
+	f := k.fetches[from]
+	if index == 0 {
+		if ok && version <= current {
+			// We already have this table or a newer one
+			delete(k.fetches, from)
+			k.mutex.Unlock()
+			return
+		}
+		f = &tableFetch{version: version, total: total}
+		k.fetches[from] = f
+	} else if f == nil || f.version != version || f.total != total || f.next != index {
+		k.mutex.Unlock()
+		return
+	}
+	f.data = append(f.data, chunk...)
+	f.next++
+	next, done := f.next, f.next == f.total
+	if done {
+		delete(k.fetches, from)
+	}
+	k.mutex.Unlock()
+	if !done {
+		k.sendTableRequest(fromKey, next)
+		return
+	}
+	applied, err := k.ckr.applyTable(f.data)
+	if err != nil {
+		k.log.Warnln("Rejected routing table from", hex.EncodeToString(fromKey), ":", err)
+		return
+	}
+	if applied && settings.cache != "" {
+		k.ckr.saveCachedTable(settings.cache, f.data)
+	}
+}
+
+// Asks each of the controller nodes for the start of its routing table. The
+// rest of the table is only requested if it is newer than the one we have.
+func (k *keyStore) requestTables() {
+	settings := k.ckr.controllerSettings()
+	if !k.ckr.isEnabled() || settings.key == nil {
+		return
+	}
+	for key := range settings.nodes {
+		k.sendTableRequest(ed25519.PublicKey(append([]byte(nil), key[:]...)), 0)
+	}
+}
+
+func (k *keyStore) sendTableRequest(dest ed25519.PublicKey, index uint16) {
+	bs := []byte{typeTableRequest, 0, 0}
+	binary.BigEndian.PutUint16(bs[1:3], index)
+	msg := append(append([]byte(nil), dest...), bs[1:3]...)
+	_ = k.core.SendOutOfBand(dest, append(bs, ed25519.Sign(k.core.PrivateKey(), msg)...))
+}
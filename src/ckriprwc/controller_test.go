@@ -0,0 +1,43 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestOpenTable(t *testing.T) {
+	adminPub, adminPriv, _ := ed25519.GenerateKey(nil)
+	nodePub, _, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	sign := func(table *signedTable) []byte {
+		bs, err := json.Marshal(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(ed25519.Sign(adminPriv, bs), bs...)
+	}
+
+	signed := sign(&signedTable{Version: 3, Node: hex.EncodeToString(nodePub)})
+	table, err := openTable(adminPub, nodePub, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Version != 3 {
+		t.Errorf("Opened table version %d, expected 3", table.Version)
+	}
+	if _, err := openTable(adminPub, otherPub, signed); err == nil {
+		t.Error("Expected a table for another node to be rejected")
+	}
+	if _, err := openTable(otherPub, nodePub, signed); err == nil {
+		t.Error("Expected a table signed by another key to be rejected")
+	}
+	signed[len(signed)-2] ^= 1
+	if _, err := openTable(adminPub, nodePub, signed); err == nil {
+		t.Error("Expected a modified table to be rejected")
+	}
+	if _, err := openTable(adminPub, otherPub, sign(&signedTable{Version: 1})); err != nil {
+		t.Errorf("Expected a global table to be accepted by any node: %s", err)
+	}
+}
@@ -18,169 +18,659 @@ import (
 )
 
 type cryptokey struct {
-	core    *core.Core
-	log     *log.Logger
-	config  *config.TunnelRoutingConfig
-	enabled atomic.Value // bool
-	sync.RWMutex
-	v4Routes []*route
-	v6Routes []*route
+	core       *core.Core
+	log        *log.Logger
+	config     *config.TunnelRoutingConfig // The configuration given at startup, applied by configure
+	mutex      sync.Mutex                  // Serialises changes to the routing table
+	state      atomic.Value                // *ckrState, replaced as a whole while holding mutex
+	learned    map[keyArray]*announcement  // Routes advertised by trusted announcers, protected by mutex
+	controlled *controlledTable            // The table from a route controller, protected by mutex
+	traffic    sync.Map                    // netip.Prefix -> *trafficCounters
+	refresh    chan struct{}
+	changed    func() // Called after the routing table changes, protected by mutex
+}
+
+// The running configuration together with the settings parsed from it and the
+// routing table. It is never modified once stored, only replaced, so that a
+// packet which loads it once sees the routing table and the settings of the
+// same configuration.
+type ckrState struct {
+	config     *config.TunnelRoutingConfig
+	enabled    bool
+	clamp      bool // Whether to clamp the MSS of TCP segments
+	sources    *sourceFilter
+	adverts    *advertConfig
+	controller *controllerConfig
+	table      *routeTable
+	reach      map[keyArray]*keyState // Rebuilt whenever the table changes
 }
 
 type route struct {
-	Prefix      netip.Prefix
-	destination ed25519.PublicKey
+	Prefix   netip.Prefix
+	gateways []*gateway // Sorted from most to least preferred
+	origin   RouteOrigin
+	mss      uint16           // The MSS to clamp TCP segments to, or 0 to derive it from the MTU
+	traffic  *trafficCounters // Shared by all routes for the prefix
 }
 
-// Configure the CKR routes. This should only ever be ran by the TUN/TAP actor.
-func (c *cryptokey) configure() error {
-	// Set enabled/disabled state
-	c.setEnabled(c.config.Enable)
-	if !c.config.Enable {
-		return nil
+// RouteOrigin describes where a crypto-key route came from. When routes for
+// the same prefix come from several places, the origin with the lowest value
+// takes precedence.
+type RouteOrigin uint8
+
+const (
+	RouteConfigured RouteOrigin = iota // Configured locally
+	RouteControlled                    // From a signed table distributed by a route controller
+	RouteAdvertised                    // Advertised by a trusted announcer
+)
+
+func (o RouteOrigin) String() string {
+	switch o {
+	case RouteConfigured:
+		return "configured"
+	case RouteControlled:
+		return "controlled"
+	case RouteAdvertised:
+		return "advertised"
 	}
+	return "unknown"
+}
 
-	c.Lock()
-	c.v4Routes = make([]*route, 0, len(c.config.IPv4RemoteSubnets))
-	c.v6Routes = make([]*route, 0, len(c.config.IPv6RemoteSubnets))
-	c.Unlock()
-	i := 0
-	for {
-		if len(c.core.GetPeers()) > 0 {
-			for ipv6, pubkey := range c.config.IPv6RemoteSubnets {
-				if err := c.addRemoteSubnet(ipv6, pubkey); err != nil {
-					return fmt.Errorf("Error adding routed IPv6 subnet: %w", err)
-				}
-			}
-			for ipv4, pubkey := range c.config.IPv4RemoteSubnets {
-				if err := c.addRemoteSubnet(ipv4, pubkey); err != nil {
-					return fmt.Errorf("Error adding routed IPv4 subnet: %w", err)
-				}
-			}
+func (o RouteOrigin) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+type gateway struct {
+	key      ed25519.PublicKey
+	priority uint8
+	reach    *keyState
+}
+
+// Gateway describes one of the remote nodes that a route can tunnel traffic to.
+type Gateway struct {
+	PublicKey ed25519.PublicKey
+	Priority  uint8
+	State     RouteState
+	LastSeen  time.Time
+}
+
+// Destination returns the public key of the node that the route currently
+// tunnels traffic to.
+func (r *route) Destination() ed25519.PublicKey {
+	return r.selectGateway(0).key
+}
+
+// State returns whether the current destination of the route is reachable.
+func (r *route) State() RouteState {
+	return r.selectGateway(0).state()
+}
+
+// LastSeen returns when the current destination of the route last answered a
+// lookup or sent traffic, or the zero time if it has never been heard from.
+func (r *route) LastSeen() time.Time {
+	return r.selectGateway(0).lastSeen()
+}
+
+// Origin returns where the route came from.
+func (r *route) Origin() RouteOrigin {
+	return r.origin
+}
+
+// Gateways returns all of the nodes that the route can tunnel traffic to, from
+// most to least preferred.
+func (r *route) Gateways() []Gateway {
+	gateways := make([]Gateway, 0, len(r.gateways))
+	for _, g := range r.gateways {
+		gateways = append(gateways, Gateway{
+			PublicKey: g.key,
+			Priority:  g.priority,
+			State:     g.state(),
+			LastSeen:  g.lastSeen(),
+		})
+	}
+	return gateways
+}
+
+// Returns the gateway to send the flow with the given hash to. Flows are
+// balanced across the reachable gateways which have the most preferred
+// priority. If none of them are reachable then the gateways which haven't been
+// found to be unreachable are used, failing that all of the gateways.
+func (r *route) selectGateway(flow uint64) *gateway {
+	if g := r.pickGateway(flow, RouteReachable); g != nil {
+		return g
+	}
+	if g := r.pickGateway(flow, RoutePending); g != nil {
+		return g
+	}
+	return r.pickGateway(flow, RouteUnreachable)
+}
+
+// Picks one of the gateways in the given state which share the most preferred
+// priority among the gateways in that state, using the flow hash to choose
+// between them. Returns nil if no gateway is in the given state.
+func (r *route) pickGateway(flow uint64, state RouteState) *gateway {
+	var first, count int
+	for i, g := range r.gateways {
+		if g.state() != state {
+			continue
+		}
+		if count > 0 && g.priority != r.gateways[first].priority {
 			break
-		} else {
-			i++
-			if i > 10 {
-				return fmt.Errorf("No peers has been added")
-			}
-			time.Sleep(6 * time.Second)
 		}
+		if count == 0 {
+			first = i
+		}
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	n := int(flow % uint64(count))
+	for _, g := range r.gateways[first:] {
+		if g.state() != state {
+			continue
+		}
+		if n == 0 {
+			return g
+		}
+		n--
+	}
+	return r.gateways[first]
+}
+
+// Checks whether the given key is one of the gateways of the route.
+func (r *route) hasGateway(key ed25519.PublicKey) bool {
+	for _, g := range r.gateways {
+		if g.key.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether both routes have the same gateways with the same priorities.
+func (r *route) sameGateways(o *route) bool {
+	if len(r.gateways) != len(o.gateways) || r.origin != o.origin {
+		return false
+	}
+	for i, g := range r.gateways {
+		if !g.key.Equal(o.gateways[i].key) || g.priority != o.gateways[i].priority {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *gateway) state() RouteState {
+	if g.reach == nil {
+		return RoutePending
+	}
+	return g.reach.getState()
+}
+
+func (g *gateway) lastSeen() time.Time {
+	if g.reach == nil {
+		return time.Time{}
+	}
+	return g.reach.getLastSeen()
+}
+
+// The source addresses that packets from the TUN adapter may use when strict
+// source checking is enabled, in addition to our own address and subnet.
+type sourceFilter struct {
+	strict  bool
+	subnets *routeTable
+}
+
+// The settings parsed from a tunnel routing configuration, so that all of it
+// can be checked before any of it is applied.
+type parsedConfig struct {
+	cfg        *config.TunnelRoutingConfig
+	sources    *sourceFilter
+	adverts    *advertConfig
+	controller *controllerConfig
+	table      *routeTable // The configured routes
+}
+
+// Configure the CKR routes. This should only ever be ran by the TUN/TAP actor.
+func (c *cryptokey) configure() error {
+	// The routes are installed straight away, even if there are no peers yet.
+	// The reachability of each destination is tracked separately.
+	p, err := c.parseConfig(c.config)
+	if err != nil {
+		return err
+	}
+	c.applyConfig(p)
+	return nil
+}
+
+// Replaces the CKR configuration while running. The whole configuration is
+// checked first, so that nothing is changed if any of it is invalid, and the
+// new routes are swapped in atomically, so packets are either routed using the
+// old table or the new one.
+func (c *cryptokey) reconfigure(cfg *config.TunnelRoutingConfig) error {
+	p, err := c.parseConfig(cfg)
+	if err != nil {
+		return err
 	}
+	c.applyConfig(p)
 	return nil
 }
 
-// Enable or disable crypto-key routing.
-func (c *cryptokey) setEnabled(enabled bool) {
-	c.enabled.Store(enabled)
+// Parses and checks the given configuration without applying any of it.
+func (c *cryptokey) parseConfig(cfg *config.TunnelRoutingConfig) (*parsedConfig, error) {
+	p := &parsedConfig{cfg: cfg}
+	var err error
+	if p.sources, err = parseSources(cfg); err != nil {
+		return nil, err
+	}
+	if p.adverts, err = parseAdverts(cfg); err != nil {
+		return nil, err
+	}
+	if p.controller, err = c.parseController(cfg); err != nil {
+		return nil, err
+	}
+	var routes []*route
+	if cfg.Enable {
+		if routes, err = c.parseRoutes(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if p.table, err = newRouteTable(routes); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Applies a configuration which has already been parsed and checked. The new
+// settings and the routing table built from them are published together.
+func (c *cryptokey) applyConfig(p *parsedConfig) {
+	c.mutex.Lock()
+	old := c.snapshot()
+	// Forget the routes learned from announcers which are no longer trusted,
+	// and a table signed by a controller key which is no longer trusted
+	for key := range c.learned {
+		if !p.cfg.Enable || !p.adverts.trusted[key] {
+			delete(c.learned, key)
+		}
+	}
+	if c.controlled != nil && !c.controlled.key.Equal(p.controller.key) {
+		c.controlled = nil
+	}
+	loaded := c.controlled != nil
+	next := &ckrState{
+		config:     p.cfg,
+		enabled:    p.cfg.Enable,
+		clamp:      p.cfg.ClampMSS,
+		sources:    p.sources,
+		adverts:    p.adverts,
+		controller: p.controller,
+	}
+	table := c._withDynamic(p.table)
+	c._storeState(next, table)
+	changed := c.changed
+	c.mutex.Unlock()
+	if p.sources.strict {
+		c.log.Infoln("Strict source checking enabled with", len(p.sources.subnets.all()), "local subnet(s)")
+	}
+	c.logChanges(old.table, table)
+	if changed != nil {
+		changed()
+	}
+	if !loaded && p.controller.key != nil && p.controller.cache != "" {
+		c.loadCachedTable(p.controller.cache)
+	}
+}
+
+// Returns the current state. The returned state must not be modified.
+func (c *cryptokey) snapshot() *ckrState {
+	if state, ok := c.state.Load().(*ckrState); ok {
+		return state
+	}
+	return &ckrState{
+		sources:    &sourceFilter{subnets: &routeTable{}},
+		adverts:    &advertConfig{},
+		controller: &controllerConfig{},
+		table:      &routeTable{},
+	}
+}
+
+// Check if the MSS of TCP segments should be clamped.
+func (c *cryptokey) isClampingMSS() bool {
+	return c.snapshot().clamp
 }
 
 // Check if crypto-key routing is enabled.
 func (c *cryptokey) isEnabled() bool {
-	enabled, ok := c.enabled.Load().(bool)
-	return ok && enabled
+	return c.snapshot().enabled
 }
 
-// Adds a destination route for the given CIDR to be tunnelled to the node
-// with the given BoxPubKey.
-func (c *cryptokey) addRemoteSubnet(cidr string, dest string) error {
-	prefix, err := netip.ParsePrefix(cidr)
+// Parses the local subnets from the given configuration into a source filter.
+func parseSources(cfg *config.TunnelRoutingConfig) (*sourceFilter, error) {
+	subnets := make([]*route, 0, len(cfg.IPv6LocalSubnets)+len(cfg.IPv4LocalSubnets))
+	for _, cidr := range cfg.IPv6LocalSubnets {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil || !prefix.Addr().Is6() {
+			return nil, fmt.Errorf("Error adding local IPv6 subnet: invalid prefix %q", cidr)
+		}
+		subnets = append(subnets, &route{Prefix: prefix.Masked()})
+	}
+	for _, cidr := range cfg.IPv4LocalSubnets {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil || !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("Error adding local IPv4 subnet: invalid prefix %q", cidr)
+		}
+		subnets = append(subnets, &route{Prefix: prefix.Masked()})
+	}
+	table, err := newRouteTable(subnets)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Error adding local subnet: %w", err)
 	}
-	if c.isMeshDestination(prefix.Addr()) {
-		return errors.New("can't specify RiV-mesh destination as routed subnet")
+	return &sourceFilter{
+		strict:  cfg.StrictSource,
+		subnets: table,
+	}, nil
+}
+
+// Returns the source filter of the given state, or nil if strict source
+// checking is disabled.
+func (s *ckrState) strictSources() *sourceFilter {
+	if s.sources.strict {
+		return s.sources
 	}
+	return nil
+}
 
-	c.Lock()
-	defer c.Unlock()
+// Sets the function to be called whenever the routing table changes.
+func (c *cryptokey) setChangedHandler(handler func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.changed = handler
+}
 
-	switch {
-	case prefix.Addr().Is6():
-		for _, route := range c.v6Routes {
-			if route.Prefix == prefix {
-				return fmt.Errorf("remote subnet already exists for %s", cidr)
+// Returns the current routing table. The returned table must not be modified.
+func (c *cryptokey) routes() *routeTable {
+	return c.snapshot().table
+}
+
+// Parses the remote subnets and gateways from the given configuration into
+// routes. A prefix that appears in both is routed to all of the given nodes.
+func (c *cryptokey) parseRoutes(cfg *config.TunnelRoutingConfig) ([]*route, error) {
+	var routes []*route
+	byPrefix := make(map[netip.Prefix]*route)
+	add := func(cidr string, dest string, priority uint8) error {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		bpk, err := hex.DecodeString(dest)
+		if err != nil {
+			return fmt.Errorf("hex.DecodeString: %w", err)
+		}
+		g, err := newGateway(bpk, priority)
+		if err != nil {
+			return err
+		}
+		if r := byPrefix[prefix.Masked()]; r != nil {
+			if r.hasGateway(g.key) {
+				return fmt.Errorf("gateway %s already exists for %s", dest, cidr)
 			}
+			r.gateways = append(r.gateways, g)
+			sortGateways(r.gateways)
+			return nil
 		}
-
-	case prefix.Addr().Is4():
-		for _, route := range c.v4Routes {
-			if route.Prefix == prefix {
-				return fmt.Errorf("remote subnet already exists for %s", cidr)
+		r, err := c.newRoute(prefix, g)
+		if err != nil {
+			return err
+		}
+		byPrefix[r.Prefix] = r
+		routes = append(routes, r)
+		return nil
+	}
+	for ipv6, pubkey := range cfg.IPv6RemoteSubnets {
+		if err := add(ipv6, pubkey, 0); err != nil {
+			return nil, fmt.Errorf("Error adding routed IPv6 subnet: %w", err)
+		}
+	}
+	for ipv6, gateways := range cfg.IPv6RemoteGateways {
+		for _, g := range gateways {
+			if err := add(ipv6, g.PublicKey, g.Priority); err != nil {
+				return nil, fmt.Errorf("Error adding routed IPv6 subnet: %w", err)
 			}
 		}
+	}
+	for ipv4, pubkey := range cfg.IPv4RemoteSubnets {
+		if err := add(ipv4, pubkey, 0); err != nil {
+			return nil, fmt.Errorf("Error adding routed IPv4 subnet: %w", err)
+		}
+	}
+	for ipv4, gateways := range cfg.IPv4RemoteGateways {
+		for _, g := range gateways {
+			if err := add(ipv4, g.PublicKey, g.Priority); err != nil {
+				return nil, fmt.Errorf("Error adding routed IPv4 subnet: %w", err)
+			}
+		}
+	}
+	for cidr, mss := range cfg.RouteMSS {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Error setting route MSS: %w", err)
+		}
+		r := byPrefix[prefix.Masked()]
+		if r == nil {
+			return nil, fmt.Errorf("Error setting route MSS: no remote subnet exists for %s", cidr)
+		}
+		r.mss = mss
+	}
+	return routes, nil
+}
 
-	default:
-		return fmt.Errorf("unexpected prefix size")
+// Returns a gateway for the node with the given public key, after checking
+// that the key is suitable.
+func newGateway(key ed25519.PublicKey, priority uint8) (*gateway, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("incorrect key length for %q", hex.EncodeToString(key))
+	}
+	g := &gateway{
+		key:      make(ed25519.PublicKey, ed25519.PublicKeySize),
+		priority: priority,
 	}
+	copy(g.key, key)
+	return g, nil
+}
 
-	if bpk, err := hex.DecodeString(dest); err != nil {
-		return fmt.Errorf("hex.DecodeString: %w", err)
-	} else {
-		destination := make(ed25519.PublicKey, ed25519.PublicKeySize)
-		if copy(destination[:], bpk) != ed25519.PublicKeySize {
-			return fmt.Errorf("incorrect key length for %q", dest)
-		}
-
-		switch {
-		case prefix.Addr().Is6():
-			c.v6Routes = append(c.v6Routes, &route{
-				Prefix:      prefix,
-				destination: destination,
-			})
-			sort.Slice(c.v6Routes, func(i, j int) bool {
-				return c.v6Routes[i].Prefix.Bits() > c.v6Routes[j].Prefix.Bits()
-			})
-			c.log.Infoln("Added routed IPv6 subnet", cidr)
-
-		case prefix.Addr().Is4():
-			c.v4Routes = append(c.v4Routes, &route{
-				Prefix:      prefix,
-				destination: destination,
-			})
-			sort.Slice(c.v4Routes, func(i, j int) bool {
-				return c.v4Routes[i].Prefix.Bits() > c.v4Routes[j].Prefix.Bits()
-			})
-			c.log.Infoln("Added routed IPv4 subnet", cidr)
-		}
+// Sorts gateways from most to least preferred.
+func sortGateways(gateways []*gateway) {
+	sort.SliceStable(gateways, func(i, j int) bool {
+		return gateways[i].priority < gateways[j].priority
+	})
+}
 
-		return nil
+// Returns a route for the given prefix to be tunnelled to the given gateways,
+// after checking that the prefix is suitable.
+func (c *cryptokey) newRoute(prefix netip.Prefix, gateways ...*gateway) (*route, error) {
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() && !prefix.Addr().Is6() {
+		return nil, fmt.Errorf("unexpected prefix size")
 	}
+	if c.isMeshDestination(prefix.Addr()) {
+		return nil, errors.New("can't specify RiV-mesh destination as routed subnet")
+	}
+	if len(gateways) == 0 {
+		return nil, fmt.Errorf("no gateways given for %s", prefix)
+	}
+	sortGateways(gateways)
+	return &route{
+		Prefix:   prefix,
+		gateways: gateways,
+		traffic:  c.routeTraffic(prefix),
+	}, nil
 }
 
-// Looks up the most specific route for the given address (with the address
-// length specified in bytes) from the crypto-key routing table. An error is
-// returned if the address is not suitable or no route was found.
-func (c *cryptokey) getPublicKeyForAddress(addr netip.Addr) (ed25519.PublicKey, error) {
-	if !c.isEnabled() {
-		return nil, fmt.Errorf("CKR not enabled")
+// Adds a destination route for the given prefix to be tunnelled to the node
+// with the given public key. A route for the same prefix which was not
+// configured locally is replaced.
+func (c *cryptokey) addRoute(prefix netip.Prefix, dest ed25519.PublicKey) error {
+	g, err := newGateway(dest, 0)
+	if err != nil {
+		return err
 	}
-	if c.isMeshDestination(addr) {
-		return nil, fmt.Errorf("can't get public key for RiV-mesh route")
+	r, err := c.newRoute(prefix, g)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	table := c.routes()
+	if old := table.get(r.Prefix); old != nil && old.origin != RouteConfigured {
+		table = table.withReplacedRoute(r)
+	} else if table, err = table.withRoute(r); err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	c._storeTable(table)
+	changed := c.changed
+	c.mutex.Unlock()
+	c.logRoute("Added", r)
+	if changed != nil {
+		changed()
 	}
+	return nil
+}
 
-	c.RLock()
-	defer c.RUnlock()
+// Removes the locally configured destination route for the given prefix. If
+// there is also a route for the prefix from elsewhere then it takes its place.
+func (c *cryptokey) removeRoute(prefix netip.Prefix) error {
+	c.mutex.Lock()
+	old := c.routes()
+	if r := old.get(prefix.Masked()); r != nil && r.origin != RouteConfigured {
+		c.mutex.Unlock()
+		return fmt.Errorf("remote subnet %s is %s, not configured locally", prefix, r.origin)
+	}
+	table, r := old.withoutRoute(prefix.Masked())
+	if r == nil {
+		c.mutex.Unlock()
+		return fmt.Errorf("no remote subnet exists for %s", prefix)
+	}
+	table = c._withDynamic(table)
+	c._storeTable(table)
+	changed := c.changed
+	c.mutex.Unlock()
+	c.logChanges(old, table)
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
 
-	switch {
-	case addr.Is6():
-		for _, route := range c.v6Routes {
-			if route.Prefix.Contains(addr) {
-				return route.destination, nil
-			}
-		}
+// Replaces all of the configured routes with the given routes. Learned routes
+// are kept for any prefixes which are not given.
+func (c *cryptokey) replaceRoutes(routes []*route) error {
+	table, err := newRouteTable(routes)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	old := c.routes()
+	table = c._withDynamic(table)
+	c._storeTable(table)
+	changed := c.changed
+	c.mutex.Unlock()
+	c.logChanges(old, table)
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
 
-	case addr.Is4():
-		for _, route := range c.v4Routes {
-			if route.Prefix.Contains(addr) {
-				return route.destination, nil
-			}
+// Applies the given change to the routes from route controllers or announcers,
+// and brings the routing table in line with them.
+func (c *cryptokey) updateDynamic(change func()) {
+	c.mutex.Lock()
+	change()
+	old := c.routes()
+	table := c._withDynamic(old)
+	if table == old {
+		c.mutex.Unlock()
+		return
+	}
+	c._storeTable(table)
+	changed := c.changed
+	c.mutex.Unlock()
+	c.logChanges(old, table)
+	if changed != nil {
+		changed()
+	}
+}
+
+// Returns a table based on the given one which includes the current routes
+// from route controllers and announcers. The caller must hold c.mutex.
+func (c *cryptokey) _withDynamic(table *routeTable) *routeTable {
+	return c._withLearned(c._withControlled(table))
+}
+
+// Logs the routes which differ between the old and new tables.
+func (c *cryptokey) logChanges(old, table *routeTable) {
+	for _, r := range old.all() {
+		if nr := table.get(r.Prefix); nr == nil || !nr.sameGateways(r) {
+			c.logRoute("Removed", r)
+		}
+	}
+	for _, r := range table.all() {
+		if or := old.get(r.Prefix); or == nil || !or.sameGateways(r) {
+			c.logRoute("Added", r)
 		}
+	}
+}
 
-	default:
-		return nil, fmt.Errorf("unexpected prefix size")
+func (c *cryptokey) logRoute(action string, r *route) {
+	kind := "routed"
+	switch r.origin {
+	case RouteControlled:
+		kind = "controlled"
+	case RouteAdvertised:
+		kind = "learned"
 	}
+	if r.Prefix.Addr().Is6() {
+		c.log.Infoln(action, kind, "IPv6 subnet", r.Prefix)
+	} else {
+		c.log.Infoln(action, kind, "IPv4 subnet", r.Prefix)
+	}
+}
 
-	return nil, fmt.Errorf("no route to %s", addr.String())
+// Looks up the public key of the gateway for the given address and flow hash
+// from the crypto-key routing table. An error is returned if the address is
+// not suitable or no route was found.
+func (c *cryptokey) getPublicKeyForAddress(addr netip.Addr, flow uint64) (ed25519.PublicKey, error) {
+	route, err := c.getRouteForAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return route.selectGateway(flow).key, nil
+}
+
+// Looks up the most specific route for the given address from the crypto-key
+// routing table. An error is returned if the address is not suitable or no
+// route was found.
+func (c *cryptokey) getRouteForAddress(addr netip.Addr) (*route, error) {
+	return c.routeForAddress(c.snapshot(), addr)
+}
+
+// Looks up the most specific route for the given address in the routing table
+// of the given state.
+func (c *cryptokey) routeForAddress(state *ckrState, addr netip.Addr) (*route, error) {
+	if !state.enabled {
+		return nil, DropCKRDisabled
+	}
+	if c.isMeshDestination(addr) {
+		return nil, fmt.Errorf("%w: can't get public key for RiV-mesh route", DropInvalidDestination)
+	}
+	if !addr.Is4() && !addr.Is6() {
+		return nil, fmt.Errorf("%w: unexpected prefix size", DropInvalidDestination)
+	}
+	if route := state.table.lookup(addr); route != nil {
+		return route, nil
+	}
+	return nil, fmt.Errorf("%w to %s", DropNoRoute, addr.String())
 }
 
 func (c *cryptokey) isMeshDestination(ip netip.Addr) bool {
@@ -0,0 +1,205 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/gologme/log"
+
+	"github.com/RiV-chain/RiV-mesh/src/core"
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+// Returns a new node which isn't connected to anything.
+func newTestCore(t *testing.T) *core.Core {
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := core.New(sk, log.New(io.Discard, "", 0), core.NetworkDomain{Prefix: "fc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+	return c
+}
+
+// Returns a cryptokey for a new node, configured with the given configuration.
+func newTestCryptokey(t *testing.T, cfg *config.TunnelRoutingConfig) *cryptokey {
+	c := &cryptokey{
+		core:    newTestCore(t),
+		config:  cfg,
+		log:     log.New(io.Discard, "", 0),
+		refresh: make(chan struct{}, 1),
+	}
+	if err := c.configure(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testKey(t *testing.T) (ed25519.PublicKey, string) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, hex.EncodeToString(pub)
+}
+
+func TestRuntimeRouteChanges(t *testing.T) {
+	_, hexA := testKey(t)
+	keyB, _ := testKey(t)
+	ckr := newTestCryptokey(t, &config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.1.0.0/16": hexA},
+	})
+	rwc := &ReadWriteCloser{}
+	rwc.ckr = ckr
+	var changes int
+	rwc.SetRoutesChangedHandler(func() { changes++ })
+
+	prefix := netip.MustParsePrefix("10.2.0.0/16")
+	if err := rwc.AddRoute(prefix, keyB); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := ckr.getPublicKeyForAddress(netip.MustParseAddr("10.2.3.4"), 0); err != nil || !key.Equal(keyB) {
+		t.Fatalf("Added route wasn't used: %v", err)
+	}
+	if err := rwc.AddRoute(netip.MustParsePrefix("10.1.2.3/16"), keyB); err == nil {
+		t.Error("Expected a duplicate route to be rejected")
+	}
+	if err := rwc.AddRoute(netip.MustParsePrefix("fc00::/8"), keyB); err == nil {
+		t.Error("Expected a route for mesh addresses to be rejected")
+	}
+	if err := rwc.RemoveRoute(prefix); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ckr.getRouteForAddress(netip.MustParseAddr("10.2.3.4")); err == nil {
+		t.Error("Removed route is still used")
+	}
+	if err := rwc.RemoveRoute(prefix); err == nil {
+		t.Error("Expected removing a missing route to fail")
+	}
+
+	if err := rwc.ReplaceRoutes(map[netip.Prefix]ed25519.PublicKey{
+		netip.MustParsePrefix("2001:db8::/32"): keyB,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if routes := rwc.Routes(); len(routes) != 1 || routes[0].Prefix.String() != "2001:db8::/32" {
+		t.Errorf("Unexpected routes %v after replacing them", routes)
+	}
+	if changes != 3 {
+		t.Errorf("Routes changed handler called %d times, expected 3", changes)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	keyA, hexA := testKey(t)
+	_, hexB := testKey(t)
+	ckr := newTestCryptokey(t, &config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.1.0.0/16": hexA},
+		TrustedAnnouncers: []string{hexA},
+	})
+	rwc := &ReadWriteCloser{}
+	rwc.ckr = ckr
+
+	// Nothing is applied if any part of the configuration is invalid
+	for name, cfg := range map[string]*config.TunnelRoutingConfig{
+		"route":      {Enable: true, IPv4RemoteSubnets: map[string]string{"10.2.0.0/16": "beef"}},
+		"source":     {Enable: true, StrictSource: true, IPv4LocalSubnets: []string{"fd00::/8"}},
+		"announcer":  {Enable: true, TrustedAnnouncers: []string{"beef"}},
+		"controller": {Enable: true, IPv4RemoteSubnets: map[string]string{"10.2.0.0/16": hexB}, ControllerKey: "beef"},
+	} {
+		if err := rwc.Reconfigure(cfg); err == nil {
+			t.Errorf("%s: Expected the configuration to be rejected", name)
+		}
+		if key, err := ckr.getPublicKeyForAddress(netip.MustParseAddr("10.1.2.3"), 0); err != nil || !key.Equal(keyA) {
+			t.Errorf("%s: The routes were changed by a rejected configuration", name)
+		}
+		if ckr.snapshot().strictSources() != nil || !ckr.advertSettings().trusted[*(*keyArray)(keyA)] {
+			t.Errorf("%s: The settings were changed by a rejected configuration", name)
+		}
+	}
+
+	if err := rwc.Reconfigure(&config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.2.0.0/16": hexB},
+		StrictSource:      true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ckr.getRouteForAddress(netip.MustParseAddr("10.1.2.3")); err == nil {
+		t.Error("The old route is still used")
+	}
+	if _, err := ckr.getRouteForAddress(netip.MustParseAddr("10.2.3.4")); err != nil {
+		t.Error("The new route isn't used")
+	}
+	if ckr.snapshot().strictSources() == nil || len(ckr.advertSettings().trusted) != 0 {
+		t.Error("The new settings weren't applied")
+	}
+	if err := rwc.Reconfigure(&config.TunnelRoutingConfig{}); err != nil || rwc.Enabled() {
+		t.Fatal("Expected CKR to be disabled")
+	}
+	if len(rwc.Routes()) != 0 {
+		t.Error("Routes are still installed with CKR disabled")
+	}
+}
+
+func TestReconfigureSnapshot(t *testing.T) {
+	_, hexA := testKey(t)
+	cfgA := &config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.1.0.0/16": hexA},
+	}
+	cfgB := &config.TunnelRoutingConfig{
+		Enable:            true,
+		StrictSource:      true,
+		IPv4LocalSubnets:  []string{"192.168.1.0/24"},
+		IPv4RemoteSubnets: map[string]string{"10.2.0.0/16": hexA},
+	}
+	ckr := newTestCryptokey(t, cfgA)
+
+	// Packets handled while the configuration changes always see the routing
+	// table and the source filter of the same configuration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			cfg := cfgA
+			if i%2 == 0 {
+				cfg = cfgB
+			}
+			if err := ckr.reconfigure(cfg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		state := ckr.snapshot()
+		_, errA := ckr.routeForAddress(state, netip.MustParseAddr("10.1.2.3"))
+		_, errB := ckr.routeForAddress(state, netip.MustParseAddr("10.2.2.3"))
+		switch state.config {
+		case cfgA:
+			if errA != nil || errB == nil || state.strictSources() != nil {
+				t.Fatal("The state doesn't match the first configuration")
+			}
+		case cfgB:
+			if errA == nil || errB != nil || state.strictSources() == nil {
+				t.Fatal("The state doesn't match the second configuration")
+			}
+		default:
+			t.Fatal("Unexpected configuration in the state")
+		}
+	}
+}
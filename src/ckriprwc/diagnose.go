@@ -0,0 +1,136 @@
+package ckriprwc
+
+// The diagnose module explains how packets to and from an address would be
+// handled, both when they are sent from the TUN adapter and when their source
+// is validated on the way in from the mesh, so that asymmetric routes can be
+// debugged without sending any traffic.
+
+import (
+	"crypto/ed25519"
+	"net/netip"
+
+	"github.com/RiV-chain/RiV-mesh/src/core"
+)
+
+// Diagnosis explains how packets to and from an address are handled.
+type Diagnosis struct {
+	Address     netip.Addr
+	MeshAddress bool // Whether the address is a mesh address
+	MeshSubnet  bool // Whether the address is in a mesh subnet
+	Outbound    OutboundDiagnosis
+	Inbound     InboundDiagnosis
+}
+
+// OutboundDiagnosis explains how packets sent to an address from the TUN
+// adapter are handled.
+type OutboundDiagnosis struct {
+	Prefix      netip.Prefix      // The crypto-key route that matches, if any
+	Origin      RouteOrigin       // Where the route came from
+	Key         ed25519.PublicKey // The key that packets are sent to, or nil if it is not known yet
+	Cached      bool              // Whether the key is in the key store cache
+	Lookup      bool              // Whether the key has to be looked up first
+	Unreachable bool              // Whether the destination is negatively cached
+	MTU         int               // The largest packet that is sent without being fragmented
+	Err         error             // Why packets are dropped, if they are
+}
+
+// InboundDiagnosis explains how packets received from the mesh with an
+// address as their source are handled.
+type InboundDiagnosis struct {
+	Prefix netip.Prefix        // The crypto-key route that matches, if any
+	Keys   []ed25519.PublicKey // The keys that packets are accepted from, if they are known
+	From   ed25519.PublicKey   // The key that was checked, if one was given
+	MTU    int                 // The largest packet passed to the TUN adapter without being fragmented
+	Err    error               // Why packets from the given key are dropped, if they are
+}
+
+// Explains how packets to and from the given address are handled. If from is
+// given then it is checked whether packets from the address are accepted from
+// that key.
+func (k *keyStore) diagnose(addr netip.Addr, from ed25519.PublicKey) Diagnosis {
+	d := Diagnosis{Address: addr}
+	var meshAddr core.Address
+	var meshSubnet core.Subnet
+	if addr.Is6() {
+		copy(meshAddr[:], addr.AsSlice())
+		copy(meshSubnet[:], addr.AsSlice())
+		d.MeshAddress = k.core.IsValidAddress(meshAddr)
+		d.MeshSubnet = !d.MeshAddress && k.core.IsValidSubnet(meshSubnet)
+	}
+
+	out := &d.Outbound
+	var info *keyInfo
+	var buf *buffer
+	switch {
+	case d.MeshAddress:
+		k.mutex.Lock()
+		info, buf = k.addrToInfo[meshAddr], k.addrBuffer[meshAddr]
+		k.mutex.Unlock()
+	case d.MeshSubnet:
+		k.mutex.Lock()
+		info, buf = k.subnetToInfo[meshSubnet], k.subnetBuffer[meshSubnet]
+		k.mutex.Unlock()
+	default:
+		route, err := k.ckr.getRouteForAddress(addr)
+		if err != nil {
+			out.Err = err
+			break
+		}
+		out.Prefix, out.Origin = route.Prefix, route.origin
+		out.Key = route.selectGateway(0).key
+		var key keyArray
+		copy(key[:], out.Key)
+		k.mutex.Lock()
+		info = k.keyToInfo[key]
+		k.mutex.Unlock()
+	}
+	if info != nil {
+		out.Key = append(ed25519.PublicKey(nil), info.key[:]...)
+		out.Cached = true
+	} else if d.MeshAddress || d.MeshSubnet {
+		out.Lookup = true
+		k.mutex.Lock()
+		out.Unreachable = buf != nil && buf.isUnreachable()
+		k.mutex.Unlock()
+		if out.Unreachable {
+			out.Err = DropUnreachable
+		}
+	}
+	out.MTU = int(k.core.MTU())
+	if out.Key != nil {
+		var key keyArray
+		copy(key[:], out.Key)
+		if mtu := k.pmtu.get(key); mtu != 0 && mtu < out.MTU {
+			out.MTU = mtu
+		}
+	}
+
+	in := &d.Inbound
+	in.MTU = int(k.MTU())
+	switch {
+	case d.MeshAddress:
+		if out.Cached {
+			in.Keys = append(in.Keys, out.Key)
+		}
+	default:
+		route, err := k.ckr.getRouteForAddress(addr)
+		if err != nil {
+			in.Err = err
+			break
+		}
+		in.Prefix = route.Prefix
+		for _, g := range route.gateways {
+			in.Keys = append(in.Keys, append(ed25519.PublicKey(nil), g.key...))
+		}
+	}
+	if len(from) == ed25519.PublicKeySize {
+		in.From = from
+		fromInfo := &keyInfo{
+			address: *k.core.AddrForKey(from),
+			subnet:  *k.core.SubnetForKey(from),
+		}
+		copy(fromInfo.key[:], from)
+		_, in.Err = k.checkSource(addr, fromInfo)
+	}
+	return d
+}
@@ -0,0 +1,67 @@
+package ckriprwc
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+func TestDiagnose(t *testing.T) {
+	keyA, hexA := testKey(t)
+	keyB, _ := testKey(t)
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.1.0.0/16": hexA},
+	})
+	infoA := testKeyInfo(&rwc.keyStore, keyA)
+	var subnetAddr [16]byte
+	copy(subnetAddr[:], infoA.subnet[:])
+	subnetAddr[15] = 1
+
+	// Mesh address, whose key is found by looking it up
+	d := rwc.Diagnose(netip.AddrFrom16(infoA.address), keyA)
+	if !d.MeshAddress || d.MeshSubnet || !d.Outbound.Lookup {
+		t.Errorf("Unexpected diagnosis of a mesh address: %+v", d)
+	}
+	if d.Inbound.Err != nil {
+		t.Errorf("Expected packets from a mesh address to be accepted from its key: %v", d.Inbound.Err)
+	}
+	if d = rwc.Diagnose(netip.AddrFrom16(infoA.address), keyB); !errors.Is(d.Inbound.Err, DropUnknownSource) {
+		t.Errorf("Expected packets from a mesh address to be dropped from another key: %v", d.Inbound.Err)
+	}
+
+	// Mesh subnet, which isn't accepted as a source
+	d = rwc.Diagnose(netip.AddrFrom16(subnetAddr), keyA)
+	if d.MeshAddress || !d.MeshSubnet {
+		t.Errorf("Unexpected diagnosis of a mesh subnet: %+v", d)
+	}
+	if len(d.Inbound.Keys) != 0 || !errors.Is(d.Inbound.Err, DropUnknownSource) {
+		t.Errorf("Expected packets from a mesh subnet to be dropped: %+v", d.Inbound)
+	}
+
+	// CKR route
+	prefix := netip.MustParsePrefix("10.1.0.0/16")
+	d = rwc.Diagnose(netip.MustParseAddr("10.1.2.3"), keyA)
+	if d.Outbound.Prefix != prefix || !d.Outbound.Key.Equal(keyA) || d.Outbound.Err != nil {
+		t.Errorf("Unexpected outbound diagnosis of a CKR address: %+v", d.Outbound)
+	}
+	if d.Inbound.Prefix != prefix || len(d.Inbound.Keys) != 1 || !d.Inbound.Keys[0].Equal(keyA) || d.Inbound.Err != nil {
+		t.Errorf("Unexpected inbound diagnosis of a CKR address: %+v", d.Inbound)
+	}
+	if d = rwc.Diagnose(netip.MustParseAddr("10.1.2.3"), keyB); !errors.Is(d.Inbound.Err, DropUnknownSource) {
+		t.Errorf("Expected packets from a CKR address to be dropped from the wrong key: %v", d.Inbound.Err)
+	}
+	if d = rwc.Diagnose(netip.MustParseAddr("10.2.2.3"), nil); !errors.Is(d.Outbound.Err, DropNoRoute) || !errors.Is(d.Inbound.Err, DropNoRoute) {
+		t.Errorf("Expected no route: %+v", d)
+	}
+
+	// CKR disabled
+	if err := rwc.Reconfigure(&config.TunnelRoutingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if d = rwc.Diagnose(netip.MustParseAddr("10.1.2.3"), keyA); !errors.Is(d.Outbound.Err, DropCKRDisabled) || !errors.Is(d.Inbound.Err, DropCKRDisabled) {
+		t.Errorf("Expected CKR to be disabled: %+v", d)
+	}
+}
@@ -0,0 +1,183 @@
+package ckriprwc
+
+// The drops module records why packets are dropped. Each reason is a typed
+// error with its own counter, and a sample of the drops can be logged along
+// with the flow of the packet that was dropped, so that crypto-key routing can
+// be troubleshot without a debugger.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+// DropReason is the reason that a packet was dropped. It is also used as the
+// error returned for the drop, so it can be matched with errors.Is.
+type DropReason int
+
+const (
+	DropNotIP              DropReason = iota // Neither an IPv4 nor an IPv6 packet
+	DropUndersized                           // Too short for its IP header
+	DropCKRDisabled                          // Needs crypto-key routing, which is disabled
+	DropNoRoute                              // No route to the destination address
+	DropInvalidDestination                   // The destination address can't be routed
+	DropUnknownSource                        // The source address isn't routed to the sending key
+	DropSourceNotLocal                       // The source address isn't local, with StrictSource set
+	DropHopLimit                             // The TTL or hop limit ran out
+	DropMTUExceeded                          // Too big for the path and can't be fragmented
+	DropUnreachable                          // The key for the destination couldn't be found
+	DropQueueFull                            // Too much was queued while looking up the key
+	DropBadFragment                          // An overlapping or malformed IPv4 fragment
+	DropReassemblyFull                       // Too many IPv4 fragments waiting for reassembly
+	numDropReasons
+)
+
+var dropReasons = [numDropReasons]struct {
+	name string
+	text string
+}{
+	DropNotIP:              {"not_ip", "not an IP packet"},
+	DropUndersized:         {"undersized", "undersized packet"},
+	DropCKRDisabled:        {"ckr_disabled", "CKR not enabled"},
+	DropNoRoute:            {"no_route", "no route"},
+	DropInvalidDestination: {"invalid_destination", "invalid destination address"},
+	DropUnknownSource:      {"unknown_source", "unknown source address"},
+	DropSourceNotLocal:     {"source_not_local", "source address is not local"},
+	DropHopLimit:           {"hop_limit", "hop limit exceeded"},
+	DropMTUExceeded:        {"mtu_exceeded", "packet too big"},
+	DropUnreachable:        {"unreachable", "destination unreachable"},
+	DropQueueFull:          {"queue_full", "pending queue full"},
+	DropBadFragment:        {"bad_fragment", "overlapping or malformed fragment"},
+	DropReassemblyFull:     {"reassembly_full", "reassembly buffer full"},
+}
+
+// String returns the name of the reason, as used in stats.
+func (r DropReason) String() string {
+	if r < 0 || r >= numDropReasons {
+		return fmt.Sprintf("drop_reason_%d", int(r))
+	}
+	return dropReasons[r].name
+}
+
+func (r DropReason) Error() string {
+	if r < 0 || r >= numDropReasons {
+		return r.String()
+	}
+	return dropReasons[r].text
+}
+
+func (r DropReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// Stats holds the counters of a ReadWriteCloser and the state of its key
+// store.
+type Stats struct {
+	Drops          map[DropReason]uint64 `json:"drops"`           // The number of packets dropped for each reason
+	CachedKeys     int                   `json:"cached_keys"`     // The number of keys in the key store
+	PendingLookups int                   `json:"pending_lookups"` // The number of key lookups in flight
+	QueuedPackets  int                   `json:"queued_packets"`  // The number of packets waiting for key lookups
+	QueuedBytes    int                   `json:"queued_bytes"`
+}
+
+// Sets how many of the dropped packets are logged from the given configuration.
+func (k *keyStore) setDropLogging(cfg *config.TunnelRoutingConfig) {
+	var sample uint64
+	if cfg.DropLogSample > 0 {
+		sample = uint64(cfg.DropLogSample)
+	}
+	atomic.StoreUint64(&k.dropSample, sample)
+}
+
+// Counts a packet dropped for the given reason, logging one in every so many
+// drops if that is enabled. Returns the reason, to be used as an error.
+func (k *keyStore) drop(reason DropReason, bs []byte) DropReason {
+	atomic.AddUint64(&k.drops[reason], 1)
+	if sample := atomic.LoadUint64(&k.dropSample); sample != 0 && atomic.AddUint64(&k.dropCount, 1)%sample == 0 {
+		k.log.Debugf("Dropped %s: %s", describeFlow(bs), reason.Error())
+	}
+	return reason
+}
+
+// Returns the reason that a route lookup failed, if it is one of ours, and
+// otherwise the given reason.
+func dropReasonFor(err error, otherwise DropReason) DropReason {
+	reason := otherwise
+	errors.As(err, &reason)
+	return reason
+}
+
+// Returns the number of packets dropped for each reason so far, along with
+// the current state of the key store.
+func (k *keyStore) stats() Stats {
+	stats := Stats{Drops: make(map[DropReason]uint64, numDropReasons)}
+	for reason := DropReason(0); reason < numDropReasons; reason++ {
+		stats.Drops[reason] = atomic.LoadUint64(&k.drops[reason])
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	stats.CachedKeys = len(k.keyToInfo)
+	stats.QueuedBytes = k.queued
+	count := func(buf *buffer) {
+		if buf.retry != nil {
+			stats.PendingLookups++
+		}
+		stats.QueuedPackets += len(buf.packets)
+	}
+	for _, buf := range k.addrBuffer {
+		count(buf)
+	}
+	for _, buf := range k.subnetBuffer {
+		count(buf)
+	}
+	return stats
+}
+
+// Describes the protocol, addresses and ports of the given IP packet.
+func describeFlow(bs []byte) string {
+	var src, dst netip.Addr
+	var proto byte
+	var l4 []byte
+	switch {
+	case len(bs) >= 20 && bs[0]&0xf0 == 0x40:
+		src = netip.AddrFrom4(*(*[4]byte)(bs[12:16]))
+		dst = netip.AddrFrom4(*(*[4]byte)(bs[16:20]))
+		proto = bs[9]
+		ihl := int(bs[0]&0x0f) * 4
+		if binary.BigEndian.Uint16(bs[6:8])&0x1fff == 0 && ihl >= 20 && len(bs) >= ihl {
+			l4 = bs[ihl:]
+		}
+	case len(bs) >= 40 && bs[0]&0xf0 == 0x60:
+		src = netip.AddrFrom16(*(*[16]byte)(bs[8:24]))
+		dst = netip.AddrFrom16(*(*[16]byte)(bs[24:40]))
+		proto = bs[6]
+		l4 = bs[40:]
+	default:
+		return fmt.Sprintf("packet of %d bytes", len(bs))
+	}
+	var name string
+	switch proto {
+	case 1:
+		name = "ICMP"
+	case 6:
+		name = "TCP"
+	case 17:
+		name = "UDP"
+	case 58:
+		name = "ICMPv6"
+	case 132:
+		name = "SCTP"
+	default:
+		return fmt.Sprintf("protocol %d %s -> %s", proto, src, dst)
+	}
+	if (proto == 6 || proto == 17 || proto == 132) && len(l4) >= 4 {
+		srcPort := binary.BigEndian.Uint16(l4[0:2])
+		dstPort := binary.BigEndian.Uint16(l4[2:4])
+		return fmt.Sprintf("%s %s -> %s", name, netip.AddrPortFrom(src, srcPort), netip.AddrPortFrom(dst, dstPort))
+	}
+	return fmt.Sprintf("%s %s -> %s", name, src, dst)
+}
@@ -0,0 +1,38 @@
+package ckriprwc
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestDropReasons(t *testing.T) {
+	k := &keyStore{}
+	if _, err := k.writePC([]byte{0x00, 0x01}); !errors.Is(err, DropNotIP) {
+		t.Errorf("Got %v for a non-IP packet, expected %v", err, DropNotIP)
+	}
+	if _, err := k.writePC([]byte{0x45, 0x00}); !errors.Is(err, DropUndersized) {
+		t.Errorf("Got %v for an undersized packet, expected %v", err, DropUndersized)
+	}
+	stats := k.stats()
+	if stats.Drops[DropNotIP] != 1 || stats.Drops[DropUndersized] != 1 || stats.Drops[DropNoRoute] != 0 {
+		t.Errorf("Unexpected drop counters %v", stats.Drops)
+	}
+
+	packet, err := ipv4Header_Marshal(&ipv4.Header{
+		TotalLen: 28,
+		TTL:      64,
+		Protocol: 17,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(10, 1, 2, 3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet = append(packet, 0x30, 0x39, 0x00, 0x35, 0, 8, 0, 0)
+	if flow := describeFlow(packet); flow != "UDP 192.168.1.2:12345 -> 10.1.2.3:53" {
+		t.Errorf("Described flow as %q", flow)
+	}
+}
@@ -0,0 +1,64 @@
+package ckriprwc
+
+// The flow module identifies which flow a packet belongs to, so that all of
+// the packets of one TCP or UDP flow are sent to the same gateway when a route
+// is balanced across several of them.
+
+import "encoding/binary"
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// Mixes the given bytes into an FNV-1a hash.
+func fnvAdd(h uint64, bs []byte) uint64 {
+	for _, b := range bs {
+		h ^= uint64(b)
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// Returns a hash of the addresses, protocol and ports of the given IP packet.
+// Ports are only included for TCP and SCTP packets which are not fragmented.
+// They are never included for UDP, as large UDP datagrams are often
+// fragmented and the fragments after the first carry no ports, so that all of
+// the packets of a UDP flow hash to the same value whether or not they are
+// fragmented. The fragments of an IPv6 packet hash by the protocol in their
+// fragment header, like unfragmented packets.
+func flowHash(bs []byte) uint64 {
+	h := uint64(fnvOffset64)
+	var proto byte
+	var l4 []byte
+	switch {
+	case len(bs) >= 20 && bs[0]&0xf0 == 0x40:
+		ihl := int(bs[0]&0x0f) * 4
+		proto = bs[9]
+		h = fnvAdd(h, bs[12:20])
+		fragmented := binary.BigEndian.Uint16(bs[6:8])&0x3fff != 0 // MF or offset
+		if !fragmented && ihl >= 20 && len(bs) >= ihl {
+			l4 = bs[ihl:]
+		}
+	case len(bs) >= 40 && bs[0]&0xf0 == 0x60:
+		proto = bs[6]
+		h = fnvAdd(h, bs[8:40])
+		l4 = bs[40:]
+		if proto == 44 { // Fragment header
+			if len(bs) >= 48 {
+				proto = bs[40]
+			}
+			l4 = nil
+		}
+	default:
+		return h
+	}
+	h = fnvAdd(h, []byte{proto})
+	switch proto {
+	case 6, 132: // TCP, SCTP
+		if len(l4) >= 4 {
+			h = fnvAdd(h, l4[:4])
+		}
+	}
+	return h
+}
@@ -0,0 +1,87 @@
+package ckriprwc
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// Returns a UDP packet from src to dst with the given ports and payload size.
+func testUDPPacket(src, dst netip.Addr, sport, dport uint16, size int) []byte {
+	bs := testPacket(src, dst)
+	hlen := 40
+	if src.Is4() {
+		hlen = 20
+	}
+	bs = append(bs[:hlen+8], make([]byte, size)...)
+	binary.BigEndian.PutUint16(bs[hlen:], sport)
+	binary.BigEndian.PutUint16(bs[hlen+2:], dport)
+	if src.Is4() {
+		binary.BigEndian.PutUint16(bs[2:4], uint16(len(bs)))
+		bs[10], bs[11] = 0, 0
+		csum := ipv4Checksum(bs[:20])
+		bs[10], bs[11] = byte(csum>>8), byte(csum)
+	} else {
+		binary.BigEndian.PutUint16(bs[4:6], uint16(len(bs)-40))
+	}
+	return bs
+}
+
+// Returns the given IPv6 packet with a fragment header for the given offset.
+func testIPv6Fragment(bs []byte, offset int, more bool) []byte {
+	frag := make([]byte, 8)
+	frag[0] = bs[6]
+	off := uint16(offset/8) << 3
+	if more {
+		off |= 1
+	}
+	binary.BigEndian.PutUint16(frag[2:4], off)
+	binary.BigEndian.PutUint32(frag[4:8], 1234)
+	out := append(append(append([]byte(nil), bs[:40]...), frag...), bs[40:]...)
+	out[6] = 44
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(out)-40))
+	return out
+}
+
+func TestFlowHashFragments(t *testing.T) {
+	src4, dst4 := netip.MustParseAddr("192.168.1.2"), netip.MustParseAddr("10.1.2.3")
+	src6, dst6 := netip.MustParseAddr("2001:db8:1::2"), netip.MustParseAddr("2001:db8:2::3")
+
+	// An IPv4 UDP flow with small, unfragmented datagrams and large ones
+	// which are split into several fragments
+	small := testUDPPacket(src4, dst4, 5000, 53, 100)
+	large := testUDPPacket(src4, dst4, 5000, 53, 3000)
+	frags := fragmentIPv4(large, 1280)
+	if len(frags) < 3 {
+		t.Fatalf("Expected the datagram to be fragmented, got %d fragments", len(frags))
+	}
+	flow := flowHash(small)
+	for i, frag := range append(frags, large) {
+		if flowHash(frag) != flow {
+			t.Errorf("IPv4 packet %d of the flow hashed differently", i)
+		}
+	}
+
+	// The same for IPv6, where the fragments carry a fragment header
+	small = testUDPPacket(src6, dst6, 5000, 53, 100)
+	large = testUDPPacket(src6, dst6, 5000, 53, 3000)
+	flow = flowHash(small)
+	for i, frag := range [][]byte{
+		testIPv6Fragment(large[:1272], 0, true),
+		testIPv6Fragment(append(large[:40:40], large[1272:2504]...), 1232, true),
+		testIPv6Fragment(append(large[:40:40], large[2504:]...), 2464, false),
+		large,
+	} {
+		if flowHash(frag) != flow {
+			t.Errorf("IPv6 packet %d of the flow hashed differently", i)
+		}
+	}
+
+	// TCP flows are still told apart by their ports
+	tcpA := testUDPPacket(src4, dst4, 5000, 80, 100)
+	tcpB := testUDPPacket(src4, dst4, 5001, 80, 100)
+	tcpA[9], tcpB[9] = 6, 6
+	if flowHash(tcpA) == flowHash(tcpB) {
+		t.Error("TCP flows with different ports hashed the same")
+	}
+}
@@ -0,0 +1,297 @@
+package ckriprwc
+
+// The fragment module fragments and reassembles IPv4 packets. Packets which
+// are too big for the path to their destination but may be fragmented are
+// split up before being sent across the mesh, rather than being dropped.
+// Fragments received from the mesh are reassembled before being passed to the
+// TUN adapter, and fragmented again if necessary, so that the local network
+// stack only ever sees clean, non-overlapping fragments. Fragments which
+// overlap each other cause the whole datagram to be dropped, and the memory
+// used for reassembly is capped, both in total and for each sending key.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	iwt "github.com/Arceliar/ironwood/types"
+)
+
+const (
+	reassemblyTimeout   = 30 * time.Second     // How long to wait for the rest of a datagram, as in RFC 791
+	reassemblyMemory    = 4 * 1024 * 1024      // Maximum number of bytes buffered across all datagrams
+	reassemblyKeyMemory = reassemblyMemory / 8 // Maximum number of bytes buffered for the datagrams from each key
+	datagramCost        = 256                  // The bytes counted for each datagram on top of its payload
+	maxKeyDatagrams     = 64                   // Maximum number of datagrams being reassembled from each key
+	maxFragments        = 64                   // Maximum number of fragments per datagram
+	maxDatagramPayload  = 65535 - 20           // The largest payload an IPv4 datagram can have
+)
+
+// Checks whether the given IPv4 packet is a fragment, i.e. has MF set or a
+// non-zero fragment offset.
+func isFragment(bs []byte) bool {
+	return binary.BigEndian.Uint16(bs[6:8])&0x3fff != 0
+}
+
+// Splits the given IPv4 packet into fragments of at most mtu bytes. The first
+// fragment keeps all of the IP options and the others only those which must
+// be copied into every fragment. Returns nil if the packet has DF set or the
+// MTU is too small to fragment it.
+func fragmentIPv4(bs []byte, mtu int) [][]byte {
+	ihl := int(bs[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(bs[2:4]))
+	flags := binary.BigEndian.Uint16(bs[6:8])
+	if flags&0x4000 != 0 || ihl < 20 || total < ihl || total > len(bs) {
+		return nil
+	}
+	// Work out the header used for the second and later fragments
+	later := append([]byte(nil), bs[:20]...)
+	for i := 20; i < ihl; {
+		switch opt := bs[i]; {
+		case opt == 0:
+			i = ihl
+			continue
+		case opt == 1:
+			i++
+			continue
+		case i+1 >= ihl || bs[i+1] < 2 || i+int(bs[i+1]) > ihl:
+			return nil
+		case opt&0x80 != 0:
+			later = append(later, bs[i:i+int(bs[i+1])]...)
+		}
+		i += int(bs[i+1])
+	}
+	for len(later)%4 != 0 {
+		later = append(later, 0)
+	}
+	if mtu-ihl < 8 || mtu-len(later) < 8 {
+		return nil
+	}
+	payload := bs[ihl:total]
+	offset := int(flags&0x1fff) * 8
+	more := flags&0x2000 != 0
+	var frags [][]byte
+	header := bs[:ihl]
+	for pos := 0; pos < len(payload); {
+		n := (mtu - len(header)) &^ 7
+		if pos+n >= len(payload) {
+			n = len(payload) - pos
+		}
+		frag := make([]byte, len(header)+n)
+		copy(frag, header)
+		copy(frag[len(header):], payload[pos:pos+n])
+		frag[0] = 0x40 | byte(len(header)/4)
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		fragFlags := uint16((offset + pos) / 8)
+		if more || pos+n < len(payload) {
+			fragFlags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(frag[6:8], fragFlags)
+		binary.BigEndian.PutUint16(frag[10:12], 0)
+		binary.BigEndian.PutUint16(frag[10:12], ipv4Checksum(frag[:len(header)]))
+		frags = append(frags, frag)
+		pos += n
+		header = later
+	}
+	return frags
+}
+
+// Identifies the datagram that a fragment belongs to. The sending key is
+// included so that nodes can't interfere with each other's datagrams.
+type fragKey struct {
+	from  keyArray
+	src   [4]byte
+	dst   [4]byte
+	id    uint16
+	proto uint8
+}
+
+type fragPart struct {
+	offset int
+	data   []byte
+}
+
+// A datagram being reassembled.
+type fragDatagram struct {
+	header  []byte     // The IP header of the first fragment, once it has arrived
+	parts   []fragPart // Sorted by offset
+	size    int        // The number of bytes buffered
+	total   int        // The length of the payload, once the last fragment has arrived
+	expires time.Time
+}
+
+// The datagrams being reassembled from a single key.
+type fragUsage struct {
+	datagrams int
+	memory    int // The number of bytes counted for the datagrams
+}
+
+type reassembler struct {
+	mutex     sync.Mutex
+	datagrams map[fragKey]*fragDatagram
+	usage     map[keyArray]*fragUsage
+	memory    int // The number of bytes counted across all datagrams
+}
+
+// Adds a fragment received from the given key. Returns the reassembled
+// datagram once all of its fragments have arrived, otherwise nil. An error is
+// returned if the fragment, or the whole datagram, had to be dropped. Each
+// datagram counts for a fixed number of bytes on top of its payload, and each
+// key may only use a share of the memory, so that no key can crowd out the
+// others.
+func (r *reassembler) add(from keyArray, bs []byte) ([]byte, error) {
+	ihl := int(bs[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(bs[2:4]))
+	if ihl < 20 || total < ihl || total > len(bs) {
+		return nil, DropBadFragment
+	}
+	flags := binary.BigEndian.Uint16(bs[6:8])
+	offset := int(flags&0x1fff) * 8
+	more := flags&0x2000 != 0
+	data := bs[ihl:total]
+	if offset+len(data) > maxDatagramPayload || (more && len(data)%8 != 0) || (more && len(data) == 0) {
+		return nil, DropBadFragment
+	}
+	key := fragKey{from: from, id: binary.BigEndian.Uint16(bs[4:6]), proto: bs[9]}
+	copy(key.src[:], bs[12:16])
+	copy(key.dst[:], bs[16:20])
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.datagrams == nil {
+		r.datagrams = make(map[fragKey]*fragDatagram)
+		r.usage = make(map[keyArray]*fragUsage)
+	}
+	d := r.datagrams[key]
+	if d != nil && time.Now().After(d.expires) {
+		r._remove(key, d)
+		d = nil
+	}
+	u := r.usage[from]
+	if u == nil {
+		u = new(fragUsage)
+	}
+	if d == nil {
+		if r.memory+datagramCost+len(data) > reassemblyMemory ||
+			u.memory+datagramCost+len(data) > reassemblyKeyMemory || u.datagrams >= maxKeyDatagrams {
+			return nil, DropReassemblyFull
+		}
+		d = &fragDatagram{expires: time.Now().Add(reassemblyTimeout)}
+		r.datagrams[key] = d
+		r.usage[from] = u
+		u.datagrams++
+		u.memory += datagramCost
+		r.memory += datagramCost
+	}
+	// Find where the fragment goes, dropping the whole datagram if it
+	// overlaps another fragment that isn't an exact duplicate
+	i := 0
+	for i < len(d.parts) && d.parts[i].offset < offset {
+		i++
+	}
+	if i < len(d.parts) && d.parts[i].offset == offset && bytes.Equal(d.parts[i].data, data) {
+		return nil, nil // Duplicate
+	}
+	end := offset + len(data)
+	if (i > 0 && d.parts[i-1].offset+len(d.parts[i-1].data) > offset) ||
+		(i < len(d.parts) && (d.parts[i].offset < end || d.parts[i].offset == offset)) ||
+		(d.total != 0 && (end > d.total || (more && end == d.total) || (!more && end != d.total))) ||
+		(!more && end < d.lastEnd()) {
+		r._remove(key, d)
+		return nil, DropBadFragment
+	}
+	if len(d.parts) >= maxFragments || r.memory+len(data) > reassemblyMemory || u.memory+len(data) > reassemblyKeyMemory {
+		r._remove(key, d)
+		return nil, DropReassemblyFull
+	}
+	d.parts = append(d.parts, fragPart{})
+	copy(d.parts[i+1:], d.parts[i:])
+	d.parts[i] = fragPart{offset: offset, data: append([]byte(nil), data...)}
+	d.size += len(data)
+	u.memory += len(data)
+	r.memory += len(data)
+	if offset == 0 {
+		d.header = append([]byte(nil), bs[:ihl]...)
+	}
+	if !more {
+		d.total = end
+	}
+	if d.header == nil || d.total == 0 || d.size != d.total {
+		return nil, nil
+	}
+	// All of the fragments have arrived, and as they don't overlap they
+	// must cover the whole payload
+	packet := make([]byte, len(d.header)+d.total)
+	copy(packet, d.header)
+	for _, p := range d.parts {
+		copy(packet[len(d.header)+p.offset:], p.data)
+	}
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[6:8], 0)
+	binary.BigEndian.PutUint16(packet[10:12], 0)
+	binary.BigEndian.PutUint16(packet[10:12], ipv4Checksum(packet[:len(d.header)]))
+	r._remove(key, d)
+	return packet, nil
+}
+
+// Returns the end of the last fragment received so far.
+func (d *fragDatagram) lastEnd() int {
+	if len(d.parts) == 0 {
+		return 0
+	}
+	last := d.parts[len(d.parts)-1]
+	return last.offset + len(last.data)
+}
+
+// Removes a datagram. The caller must hold r.mutex.
+func (r *reassembler) _remove(key fragKey, d *fragDatagram) {
+	r.memory -= datagramCost + d.size
+	if u := r.usage[key.from]; u != nil {
+		if u.datagrams--; u.datagrams == 0 {
+			delete(r.usage, key.from)
+		} else {
+			u.memory -= datagramCost + d.size
+		}
+	}
+	delete(r.datagrams, key)
+}
+
+// Drops the datagrams which have not been completed in time.
+func (r *reassembler) expire() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for key, d := range r.datagrams {
+		if now.After(d.expires) {
+			r._remove(key, d)
+		}
+	}
+}
+
+// Sends the given packet to the given key, first splitting it into fragments
+// if it is an IPv4 packet which may be fragmented and is too big for the path
+// to the key.
+func (k *keyStore) writeToKey(key ed25519.PublicKey, bs []byte) (int, error) {
+	var dest keyArray
+	copy(dest[:], key)
+	limit := int(k.core.MTU())
+	if mtu := k.pmtu.get(dest); mtu != 0 && mtu < limit {
+		limit = mtu
+	}
+	var frags [][]byte
+	if len(bs) > limit && bs[0]&0xf0 == 0x40 {
+		frags = fragmentIPv4(bs, limit)
+	}
+	if frags == nil {
+		frags = [][]byte{bs}
+	}
+	for _, frag := range frags {
+		if _, err := k.core.WriteTo(frag, iwt.Addr(key)); err != nil {
+			return 0, err
+		}
+	}
+	k.keyTraffic(dest).countTx(len(bs))
+	return len(bs), nil
+}
@@ -0,0 +1,154 @@
+package ckriprwc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestFragmentReassembly(t *testing.T) {
+	original, err := ipv4Header_Marshal(&ipv4.Header{
+		TotalLen: 3000,
+		ID:       1234,
+		TTL:      64,
+		Protocol: 17,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(10, 1, 2, 3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 2980)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	original = append(original, payload...)
+
+	frags := fragmentIPv4(original, 1280)
+	if len(frags) != 3 {
+		t.Fatalf("Got %d fragments, expected 3", len(frags))
+	}
+	for _, frag := range frags {
+		if len(frag) > 1280 {
+			t.Fatalf("Fragment of %d bytes is larger than the MTU", len(frag))
+		}
+		if ipv4Checksum(frag[:20]) != 0 {
+			t.Fatal("Fragment has an invalid header checksum")
+		}
+	}
+
+	var r reassembler
+	var key keyArray
+	// Deliver the fragments out of order, with a duplicate
+	for _, i := range []int{2, 0, 2} {
+		if packet, _ := r.add(key, frags[i]); packet != nil {
+			t.Fatal("Reassembled a datagram with a missing fragment")
+		}
+	}
+	packet, err := r.add(key, frags[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, original) {
+		t.Fatal("Reassembled datagram doesn't match the original")
+	}
+	if r.memory != 0 || len(r.datagrams) != 0 {
+		t.Errorf("Reassembly buffer still holds %d bytes", r.memory)
+	}
+
+	// An overlapping fragment drops the whole datagram
+	overlap := append([]byte(nil), frags[1]...)
+	overlap[7] -= 1
+	overlap[10], overlap[11] = 0, 0
+	csum := ipv4Checksum(overlap[:20])
+	overlap[10], overlap[11] = byte(csum>>8), byte(csum)
+	r.add(key, frags[0])
+	if _, err := r.add(key, overlap); err != DropBadFragment || len(r.datagrams) != 0 {
+		t.Error("Expected the datagram to be dropped after an overlapping fragment")
+	}
+	r.add(key, frags[2])
+	if packet, _ := r.add(key, frags[1]); packet != nil {
+		t.Error("Reassembled a datagram after an overlapping fragment")
+	}
+
+	original[6] |= 0x40
+	if fragmentIPv4(original, 1280) != nil {
+		t.Error("Fragmented a packet with DF set")
+	}
+}
+
+// Returns a fragment of the datagram with the given ID.
+func testFragment(t *testing.T, id, offset int, more bool, payload []byte) []byte {
+	h := &ipv4.Header{
+		TotalLen: ipv4.HeaderLen + len(payload),
+		ID:       id,
+		FragOff:  offset / 8,
+		TTL:      64,
+		Protocol: 17,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(10, 1, 2, 3),
+	}
+	if more {
+		h.Flags = ipv4.MoreFragments
+	}
+	bs, err := ipv4Header_Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(bs, payload...)
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	var r reassembler
+	var a, b keyArray
+	a[0], b[0] = 1, 2
+
+	// Empty last fragments still use up the key's share
+	for id := 0; id < maxKeyDatagrams; id++ {
+		if _, err := r.add(a, testFragment(t, id, 8, false, nil)); err != nil {
+			t.Fatalf("Fragment %d was dropped: %s", id, err)
+		}
+	}
+	if r.memory != maxKeyDatagrams*datagramCost {
+		t.Errorf("Counted %d bytes for %d datagrams", r.memory, maxKeyDatagrams)
+	}
+	if _, err := r.add(a, testFragment(t, maxKeyDatagrams, 8, false, nil)); err != DropReassemblyFull {
+		t.Errorf("Expected a datagram over the key's limit to be dropped, got %v", err)
+	}
+	if _, err := r.add(b, testFragment(t, 0, 8, false, nil)); err != nil {
+		t.Errorf("Expected a datagram from another key to be accepted, got %v", err)
+	}
+
+	// One key can't use more than its share of the memory
+	r = reassembler{}
+	payload := make([]byte, 65528)
+	for id := 0; ; id++ {
+		if _, err := r.add(a, testFragment(t, id, 0, true, payload[:8*1024])); err != nil {
+			if err != DropReassemblyFull || id >= maxKeyDatagrams || r.usage[a].memory > reassemblyKeyMemory {
+				t.Fatalf("Unexpected error %v with %d bytes buffered", err, r.usage[a].memory)
+			}
+			break
+		}
+	}
+	if _, err := r.add(b, testFragment(t, 0, 0, true, payload[:8*1024])); err != nil {
+		t.Errorf("Expected a datagram from another key to be accepted, got %v", err)
+	}
+
+	// A fragment at the same offset with different contents is an overlap
+	r = reassembler{}
+	first := testFragment(t, 1, 0, true, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	if _, err := r.add(a, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.add(a, first); err != nil || len(r.datagrams) != 1 {
+		t.Fatal("Expected an exact duplicate to be ignored")
+	}
+	if _, err := r.add(a, testFragment(t, 1, 0, true, []byte{8, 7, 6, 5, 4, 3, 2, 1})); err != DropBadFragment {
+		t.Errorf("Expected a different fragment at the same offset to be dropped, got %v", err)
+	}
+	if len(r.datagrams) != 0 || r.memory != 0 || len(r.usage) != 0 {
+		t.Errorf("Reassembly buffer still holds %d bytes", r.memory)
+	}
+}
@@ -0,0 +1,174 @@
+package ckriprwc
+
+// The ICMP error module sends ICMP and ICMPv6 errors back to the TUN adapter
+// for packets which can't be delivered, so that applications find out straight
+// away instead of waiting for a timeout. Following RFC 1812 and RFC 4443,
+// errors are never sent about ICMP error messages, non-initial fragments or
+// packets to or from multicast, broadcast or unspecified addresses, and the
+// rate at which they are sent is limited.
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	icmpRate  = 20 // How many errors may be sent per second on average
+	icmpBurst = 50 // How many errors may be sent at once
+)
+
+type icmpError int
+
+const (
+	icmpNoRoute            icmpError = iota // There is no route to the destination
+	icmpAddressUnreachable                  // The destination didn't answer key lookups
+	icmpProhibited                          // The packet isn't allowed by the configuration
+	icmpTimeExceeded                        // The TTL or hop limit ran out
+)
+
+// A token bucket which limits how often ICMP errors are sent.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Takes a token from the bucket, returning false if there are none left.
+func (r *rateLimiter) allow(rate, burst float64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if r.last.IsZero() {
+		r.tokens = burst
+	} else if r.tokens += now.Sub(r.last).Seconds() * rate; r.tokens > burst {
+		r.tokens = burst
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// Decrements the TTL or hop limit of the given packet, as the mesh counts as a
+// single hop. Returns false without changing the packet if it has run out.
+func decrementHopLimit(bs []byte) bool {
+	switch bs[0] & 0xf0 {
+	case 0x40:
+		if bs[8] <= 1 {
+			return false
+		}
+		bs[8]--
+		// Update the header checksum incrementally, see RFC 1624
+		sum := uint32(binary.BigEndian.Uint16(bs[10:12])) + 0x0100
+		binary.BigEndian.PutUint16(bs[10:12], uint16(sum+sum>>16))
+	case 0x60:
+		if bs[7] <= 1 {
+			return false
+		}
+		bs[7]--
+	}
+	return true
+}
+
+// Checks whether an ICMPv6 error may be sent about the given IPv6 packet.
+func shouldSendICMPv6Error(bs []byte) bool {
+	if bs[6] == 58 && (len(bs) <= ipv6.HeaderLen || bs[ipv6.HeaderLen] < 128) {
+		return false // Never send an error about an ICMPv6 error message
+	}
+	src := netip.AddrFrom16(*(*[16]byte)(bs[8:24]))
+	dst := netip.AddrFrom16(*(*[16]byte)(bs[24:40]))
+	return !src.IsUnspecified() && !src.IsMulticast() && !dst.IsMulticast()
+}
+
+// Checks whether an ICMP error may be sent about the given IPv4 packet.
+func shouldSendICMPv4Error(bs []byte) bool {
+	if binary.BigEndian.Uint16(bs[6:8])&0x1fff != 0 {
+		return false // Only the first fragment gets an error
+	}
+	if ihl := int(bs[0]&0x0f) * 4; bs[9] == 1 {
+		if len(bs) <= ihl {
+			return false
+		}
+		switch ipv4.ICMPType(bs[ihl]) {
+		case ipv4.ICMPTypeDestinationUnreachable, 4 /* source quench */, ipv4.ICMPTypeRedirect,
+			ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeParameterProblem:
+			return false // Never send an error about an ICMP error message
+		}
+	}
+	src := netip.AddrFrom4(*(*[4]byte)(bs[12:16]))
+	dst := netip.AddrFrom4(*(*[4]byte)(bs[16:20]))
+	broadcast := netip.AddrFrom4([4]byte{255, 255, 255, 255})
+	return !src.IsUnspecified() && !src.IsMulticast() && src != broadcast &&
+		!dst.IsMulticast() && dst != broadcast
+}
+
+// Sends an ICMP or ICMPv6 error of the given kind about the given packet back
+// to the TUN adapter, if the packet may be answered with an error and the rate
+// limit allows it.
+func (k *keyStore) sendICMPError(bs []byte, kind icmpError) {
+	var packet []byte
+	var err error
+	switch {
+	case len(bs) >= ipv6.HeaderLen && bs[0]&0xf0 == 0x60:
+		if !shouldSendICMPv6Error(bs) || !k.icmpLimiter.allow(icmpRate, icmpBurst) {
+			return
+		}
+		// Quote as much of the packet as fits into the minimum IPv6 MTU
+		data := make([]byte, 1280-ipv6.HeaderLen-8)
+		data = data[:copy(data, bs)]
+		var mtype ipv6.ICMPType
+		var mcode int
+		var body icmp.MessageBody
+		switch kind {
+		case icmpTimeExceeded:
+			mtype, body = ipv6.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: data}
+		default:
+			mtype, body = ipv6.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: data}
+			switch kind {
+			case icmpProhibited:
+				mcode = 1
+			case icmpAddressUnreachable:
+				mcode = 3
+			}
+		}
+		src := net.IP(append([]byte(nil), k.address[:]...))
+		packet, err = CreateICMPv6(data[8:24], src, mtype, mcode, body)
+	case len(bs) >= ipv4.HeaderLen && bs[0]&0xf0 == 0x40:
+		if !shouldSendICMPv4Error(bs) || !k.icmpLimiter.allow(icmpRate, icmpBurst) {
+			return
+		}
+		// Quote as much of the packet as fits into the minimum IPv4 MTU
+		data := make([]byte, 576-ipv4.HeaderLen-8)
+		data = data[:copy(data, bs)]
+		var mtype ipv4.ICMPType
+		var mcode int
+		var body icmp.MessageBody
+		switch kind {
+		case icmpTimeExceeded:
+			mtype, body = ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: data}
+		default:
+			mtype, body = ipv4.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: data}
+			switch kind {
+			case icmpProhibited:
+				mcode = 13
+			case icmpAddressUnreachable:
+				mcode = 1
+			}
+		}
+		packet, err = CreateICMPv4(data[12:16], k.address4.AsSlice(), mtype, mcode, body)
+	default:
+		return
+	}
+	if err == nil {
+		k.deliverLocal(packet)
+	}
+}
@@ -0,0 +1,90 @@
+package ckriprwc
+
+// The ICMPv4 module implements functions to easily create ICMPv4 packets,
+// the IPv4 counterpart of the ICMPv6 module. Examples include:
+// - Destination Unreachable messages, when there is no route for a packet
+// - Time Exceeded messages, when the TTL of a packet runs out
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Returns the internet checksum of the given bytes.
+func ipv4Checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// Marshal returns the binary encoding of h, including the header checksum.
+// Options are not supported.
+func ipv4Header_Marshal(h *ipv4.Header) ([]byte, error) {
+	b := make([]byte, ipv4.HeaderLen)
+	b[0] = byte(ipv4.Version<<4 | ipv4.HeaderLen>>2)
+	b[1] = byte(h.TOS)
+	binary.BigEndian.PutUint16(b[2:4], uint16(h.TotalLen))
+	binary.BigEndian.PutUint16(b[4:6], uint16(h.ID))
+	binary.BigEndian.PutUint16(b[6:8], uint16(h.Flags)<<13|uint16(h.FragOff))
+	b[8] = byte(h.TTL)
+	b[9] = byte(h.Protocol)
+	copy(b[12:16], h.Src.To4())
+	copy(b[16:20], h.Dst.To4())
+	binary.BigEndian.PutUint16(b[10:12], ipv4Checksum(b))
+	return b, nil
+}
+
+// Creates an ICMPv4 packet based on the given icmp.MessageBody and other
+// parameters, complete with IP headers, which can be written directly to a TUN
+// adapter.
+func CreateICMPv4(dst net.IP, src net.IP, mtype ipv4.ICMPType, mcode int, mbody icmp.MessageBody) ([]byte, error) {
+	// Create the ICMPv4 message
+	icmpMessage := icmp.Message{
+		Type: mtype,
+		Code: mcode,
+		Body: mbody,
+	}
+
+	// Convert the ICMPv4 message into []byte, the checksum is calculated by
+	// Marshal when no pseudo-header is given
+	icmpMessageBuf, err := icmpMessage.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the IPv4 header
+	ipv4Header := ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(icmpMessageBuf),
+		TTL:      64,
+		Protocol: 1,
+		Src:      src,
+		Dst:      dst,
+	}
+
+	// Convert the IPv4 header into []byte
+	ipv4HeaderBuf, err := ipv4Header_Marshal(&ipv4Header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Construct the packet
+	responsePacket := make([]byte, ipv4Header.TotalLen)
+	copy(responsePacket[:ipv4.HeaderLen], ipv4HeaderBuf)
+	copy(responsePacket[ipv4.HeaderLen:], icmpMessageBuf)
+
+	// Send it back
+	return responsePacket, nil
+}
@@ -0,0 +1,52 @@
+package ckriprwc
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestCreateICMPv4(t *testing.T) {
+	original, err := ipv4Header_Marshal(&ipv4.Header{
+		TotalLen: ipv4.HeaderLen,
+		TTL:      2,
+		Protocol: 17,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(10, 1, 2, 3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decrementHopLimit(original) || original[8] != 1 {
+		t.Fatal("Expected the TTL to be decremented")
+	}
+	if ipv4Checksum(original) != 0 {
+		t.Error("Header checksum is wrong after decrementing the TTL")
+	}
+	if decrementHopLimit(original) {
+		t.Error("Expected a TTL of 1 to run out")
+	}
+
+	packet, err := CreateICMPv4(original[12:16], net.IPv4(10, 0, 0, 1), ipv4.ICMPTypeTimeExceeded, 0, &icmp.TimeExceeded{Data: original})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv4Checksum(packet[:ipv4.HeaderLen]) != 0 {
+		t.Error("Header checksum is wrong")
+	}
+	if ipv4Checksum(packet[ipv4.HeaderLen:]) != 0 {
+		t.Error("ICMP checksum is wrong")
+	}
+	msg, err := icmp.ParseMessage(1, packet[ipv4.HeaderLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != ipv4.ICMPTypeTimeExceeded {
+		t.Errorf("Unexpected ICMP type %v", msg.Type)
+	}
+	if !shouldSendICMPv4Error(original) || shouldSendICMPv4Error(packet) {
+		t.Error("Expected errors to be sent about the UDP packet but not the ICMP error")
+	}
+}
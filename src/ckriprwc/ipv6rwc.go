@@ -1,18 +1,19 @@
 package ckriprwc
 
 import (
+	"bytes"
 	"crypto/ed25519"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/netip"
 	"sync"
 	"time"
 
 	"github.com/gologme/log"
 
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv6"
-
 	iwt "github.com/Arceliar/ironwood/types"
 	"github.com/RiV-chain/RiVPN/src/config"
 
@@ -26,6 +27,10 @@ const (
 	typeKeyDummy = iota // nolint:deadcode,varcheck
 	typeKeyLookup
 	typeKeyResponse
+	typeRouteSolicit
+	typeRouteAdvert
+	typeTableRequest
+	typeTableChunk
 )
 
 type keyArray [ed25519.PublicKeySize]byte
@@ -35,6 +40,7 @@ type keyStore struct {
 	log          *log.Logger
 	ckr          *cryptokey
 	address      core.Address
+	address4     netip.Addr // The IPv4 address of the TUN adapter, derived from address
 	subnet       core.Subnet
 	mutex        sync.Mutex
 	keyToInfo    map[keyArray]*keyInfo
@@ -42,7 +48,26 @@ type keyStore struct {
 	addrBuffer   map[core.Address]*buffer
 	subnetToInfo map[core.Subnet]*keyInfo
 	subnetBuffer map[core.Subnet]*buffer
+	fetches      map[keyArray]*tableFetch // Routing tables being fetched from controller nodes
+	traffic      sync.Map                 // keyArray -> *trafficCounters
+	queueLimits  queueLimits
+	queued       int                    // The total length of the packets in all buffers
+	drops        [numDropReasons]uint64 // Packets dropped for each reason, accessed atomically
+	dropSample   uint64                 // Log one in every dropSample drops, accessed atomically
+	dropCount    uint64                 // Drops since logging was enabled, accessed atomically
+	icmpLimiter  rateLimiter
+	pmtu         pmtuCache
+	frags        reassembler
 	mtu          uint64
+	reads        chan readResult // Packets to be written to the TUN adapter
+	done         chan struct{}   // Closed when the key store is closed
+	closeOnce    sync.Once
+	peersSlot    int64 // Our slot on the core's PeersChangedSignal
+}
+
+type readResult struct {
+	packet []byte
+	err    error
 }
 
 type keyInfo struct {
@@ -50,26 +75,25 @@ type keyInfo struct {
 	address core.Address
 	subnet  core.Subnet
 	timeout *time.Timer // From calling a time.AfterFunc to do cleanup
-}
-
-type buffer struct {
-	packet  []byte
-	timeout *time.Timer
+	expires time.Time   // When the timeout fires
+	traffic *trafficCounters
 }
 
 func (k *keyStore) init(c *core.Core, cfg *config.TunnelRoutingConfig, log *log.Logger) {
 	k.core = c
 	k.log = log
 	k.ckr = &cryptokey{
-		core:   c,
-		config: cfg,
-		log:    log,
+		core:    c,
+		config:  cfg,
+		log:     log,
+		refresh: make(chan struct{}, 1),
 	}
 	if err := k.ckr.configure(); err != nil {
 		log.Errorln("Could not configure CKR: ", err)
 	}
 	k.address = *c.AddrForKey(k.core.PublicKey())
 	k.subnet = *c.SubnetForKey(k.core.PublicKey())
+	k.address4 = netip.AddrFrom4([4]byte{10, k.address[1], k.address[2], k.address[3]>>1 + 1})
 	if err := k.core.SetOutOfBandHandler(k.oobHandler); err != nil {
 		err = fmt.Errorf("tun.core.SetOutOfBandHander: %w", err)
 		log.Errorln("Could not configure oobHandler in CKR: ", err)
@@ -79,7 +103,24 @@ func (k *keyStore) init(c *core.Core, cfg *config.TunnelRoutingConfig, log *log.
 	k.addrBuffer = make(map[core.Address]*buffer)
 	k.subnetToInfo = make(map[core.Subnet]*keyInfo)
 	k.subnetBuffer = make(map[core.Subnet]*buffer)
+	k.fetches = make(map[keyArray]*tableFetch)
+	k.setQueueLimits(cfg)
+	k.setDropLogging(cfg)
 	k.mtu = 1280 // Default to something safe, expect user to set this
+	k.reads = make(chan readResult, 32)
+	k.done = make(chan struct{})
+	done := k.done
+	k.peersSlot = c.PeersChangedSignal.Connect(func(data interface{}) {
+		select {
+		case <-done:
+			// Disconnecting doesn't remove the callback from the signal,
+			// so it is ignored once the key store has been closed
+		default:
+			k.ckr.refreshNow()
+		}
+	})
+	go k.receive()
+	go k.prober()
 }
 
 func (k *keyStore) sendToAddress(addr core.Address, bs []byte) {
@@ -87,27 +128,45 @@ func (k *keyStore) sendToAddress(addr core.Address, bs []byte) {
 	if info := k.addrToInfo[addr]; info != nil {
 		k.resetTimeout(info)
 		k.mutex.Unlock()
-		_, _ = k.core.WriteTo(bs, iwt.Addr(info.key[:]))
+		if k.fitsPathMTU(info.key[:], bs) {
+			_, _ = k.writeToKey(info.key[:], bs)
+		} else {
+			k.drop(DropMTUExceeded, bs)
+		}
 	} else {
 		var buf *buffer
 		if buf = k.addrBuffer[addr]; buf == nil {
 			buf = new(buffer)
 			k.addrBuffer[addr] = buf
 		}
-		msg := append([]byte(nil), bs...)
-		buf.packet = msg
+		if buf.isUnreachable() {
+			k.mutex.Unlock()
+			k.drop(DropUnreachable, bs)
+			k.sendICMPError(bs, icmpAddressUnreachable)
+			return
+		}
+		k._enqueue(buf, bs)
 		if buf.timeout != nil {
 			buf.timeout.Stop()
 		}
+		buf.expires = time.Now().Add(keyStoreTimeout)
 		buf.timeout = time.AfterFunc(keyStoreTimeout, func() {
 			k.mutex.Lock()
 			defer k.mutex.Unlock()
 			if nbuf := k.addrBuffer[addr]; nbuf == buf {
+				buf.stop()
+				k._dequeue(buf)
 				delete(k.addrBuffer, addr)
 			}
 		})
+		partial := k.core.GetAddressKey(addr)
+		lookup := k._startLookup(buf, partial, func() bool {
+			return k.addrBuffer[addr] == buf
+		})
 		k.mutex.Unlock()
-		k.sendKeyLookup(k.core.GetAddressKey(addr))
+		if lookup {
+			k.sendKeyLookup(partial)
+		}
 	}
 }
 
@@ -116,27 +175,45 @@ func (k *keyStore) sendToSubnet(subnet core.Subnet, bs []byte) {
 	if info := k.subnetToInfo[subnet]; info != nil {
 		k.resetTimeout(info)
 		k.mutex.Unlock()
-		_, _ = k.core.WriteTo(bs, iwt.Addr(info.key[:]))
+		if k.fitsPathMTU(info.key[:], bs) {
+			_, _ = k.writeToKey(info.key[:], bs)
+		} else {
+			k.drop(DropMTUExceeded, bs)
+		}
 	} else {
 		var buf *buffer
 		if buf = k.subnetBuffer[subnet]; buf == nil {
 			buf = new(buffer)
 			k.subnetBuffer[subnet] = buf
 		}
-		msg := append([]byte(nil), bs...)
-		buf.packet = msg
+		if buf.isUnreachable() {
+			k.mutex.Unlock()
+			k.drop(DropUnreachable, bs)
+			k.sendICMPError(bs, icmpAddressUnreachable)
+			return
+		}
+		k._enqueue(buf, bs)
 		if buf.timeout != nil {
 			buf.timeout.Stop()
 		}
+		buf.expires = time.Now().Add(keyStoreTimeout)
 		buf.timeout = time.AfterFunc(keyStoreTimeout, func() {
 			k.mutex.Lock()
 			defer k.mutex.Unlock()
 			if nbuf := k.subnetBuffer[subnet]; nbuf == buf {
+				buf.stop()
+				k._dequeue(buf)
 				delete(k.subnetBuffer, subnet)
 			}
 		})
+		partial := k.core.GetSubnetKey(subnet)
+		lookup := k._startLookup(buf, partial, func() bool {
+			return k.subnetBuffer[subnet] == buf
+		})
 		k.mutex.Unlock()
-		k.sendKeyLookup(k.core.GetSubnetKey(subnet))
+		if lookup {
+			k.sendKeyLookup(partial)
+		}
 	}
 }
 
@@ -150,23 +227,31 @@ func (k *keyStore) update(key ed25519.PublicKey) *keyInfo {
 		info.key = kArray
 		info.address = *k.core.AddrForKey(ed25519.PublicKey(info.key[:]))
 		info.subnet = *k.core.SubnetForKey(ed25519.PublicKey(info.key[:]))
+		info.traffic = k.keyTraffic(kArray)
 		k.keyToInfo[info.key] = info
 		k.addrToInfo[info.address] = info
 		k.subnetToInfo[info.subnet] = info
 		k.resetTimeout(info)
-		k.mutex.Unlock()
+		var packets [][]byte
 		if buf := k.addrBuffer[info.address]; buf != nil {
-			_, _ = k.core.WriteTo(buf.packet, iwt.Addr(info.key[:]))
+			buf.stop()
+			packets = append(packets, k._dequeue(buf)...)
 			delete(k.addrBuffer, info.address)
 		}
 		if buf := k.subnetBuffer[info.subnet]; buf != nil {
-			_, _ = k.core.WriteTo(buf.packet, iwt.Addr(info.key[:]))
+			buf.stop()
+			packets = append(packets, k._dequeue(buf)...)
 			delete(k.subnetBuffer, info.subnet)
 		}
+		k.mutex.Unlock()
+		for _, packet := range packets {
+			_, _ = k.writeToKey(info.key[:], packet)
+		}
 	} else {
 		k.resetTimeout(info)
 		k.mutex.Unlock()
 	}
+	k.ckr.markSeen(kArray)
 	return info
 }
 
@@ -174,6 +259,7 @@ func (k *keyStore) resetTimeout(info *keyInfo) {
 	if info.timeout != nil {
 		info.timeout.Stop()
 	}
+	info.expires = time.Now().Add(keyStoreTimeout)
 	info.timeout = time.AfterFunc(keyStoreTimeout, func() {
 		k.mutex.Lock()
 		defer k.mutex.Unlock()
@@ -190,6 +276,19 @@ func (k *keyStore) resetTimeout(info *keyInfo) {
 }
 
 func (k *keyStore) oobHandler(fromKey, toKey ed25519.PublicKey, data []byte) {
+	if len(data) > 0 {
+		switch data[0] {
+		case typeRouteAdvert:
+			k.handleRouteAdvert(fromKey, data)
+			return
+		case typeTableRequest:
+			k.handleTableRequest(fromKey, toKey, data[1:])
+			return
+		case typeTableChunk:
+			k.handleTableChunk(fromKey, data[1:])
+			return
+		}
+	}
 	if len(data) != 1+ed25519.SignatureSize {
 		return
 	}
@@ -208,6 +307,8 @@ func (k *keyStore) oobHandler(fromKey, toKey ed25519.PublicKey, data []byte) {
 		if ed25519.Verify(fromKey, toKey[:], sig) {
 			k.update(fromKey)
 		}
+	case typeRouteSolicit:
+		k.handleRouteSolicit(fromKey, toKey, sig)
 	}
 }
 
@@ -223,13 +324,16 @@ func (k *keyStore) sendKeyResponse(dest ed25519.PublicKey) {
 	_ = k.core.SendOutOfBand(dest, bs)
 }
 
-func (k *keyStore) readPC(p []byte) (int, error) {
+// Reads packets from the mesh and passes the ones for us to readPC, until the
+// key store is closed or reading from the mesh fails.
+func (k *keyStore) receive() {
 	buf := make([]byte, k.core.MTU(), 65535)
 	for {
 		bs := buf
 		n, from, err := k.core.ReadFrom(bs)
 		if err != nil {
-			return n, err
+			k.deliver(readResult{err: err})
+			return
 		}
 		if n == 0 {
 			continue
@@ -241,68 +345,171 @@ func (k *keyStore) readPC(p []byte) (int, error) {
 		ip4 := bs[0]&0xf0 == 0x40
 		ip6 := bs[0]&0xf0 == 0x60
 		if !ip4 && !ip6 {
-			continue // not IPv6
+			k.drop(DropNotIP, bs)
+			continue
+		}
+		if (ip6 && len(bs) < 40) || (ip4 && len(bs) < 20) {
+			k.drop(DropUndersized, bs)
+			continue
+		}
+		var src netip.Addr
+		if ip4 {
+			src = netip.AddrFrom4(*(*[4]byte)(bs[12:16]))
+		} else {
+			src = netip.AddrFrom16(*(*[16]byte)(bs[8:24]))
 		}
-		if ip6 && len(bs) < 40 {
+		info := k.update(ed25519.PublicKey(from.(iwt.Addr)))
+		srcRoute, err := k.checkSource(src, info)
+		if err != nil {
+			k.drop(dropReasonFor(err, DropUnknownSource), bs)
 			continue
 		}
+		if ip4 && isFragment(bs) {
+			// Reassemble fragments, so that the local stack only gets
+			// the fragments that we make from the whole datagram. They all
+			// have the same source, which has been checked already.
+			packet, err := k.frags.add(info.key, bs)
+			if err != nil {
+				k.drop(dropReasonFor(err, DropBadFragment), bs)
+				continue
+			}
+			if bs = packet; bs == nil {
+				continue
+			}
+		}
 		k.mutex.Lock()
 		mtu := int(k.mtu)
 		k.mutex.Unlock()
-		if len(bs) > mtu {
+		if len(bs) > mtu && !(ip4 && bs[6]&0x40 == 0) {
+			// Tell the sender to use a smaller MTU, from the address that it
+			// was trying to reach so that the message is routed back to it
+			var src net.IP
 			if ip6 {
-				// Using bs would make it leak off the stack, so copy to buf
-				buf := make([]byte, 512)
-				ptb := &icmp.PacketTooBig{
-					MTU:  mtu,
-					Data: buf[:copy(buf, bs)],
-				}
-				if packet, err := CreateICMPv6(buf[8:24], buf[24:40], ipv6.ICMPTypePacketTooBig, 0, ptb); err == nil {
-					_, _ = k.writePC(packet)
-				}
+				src = append(src, bs[24:40]...)
+			} else {
+				src = append(src, bs[16:20]...)
+			}
+			if packet := createPacketTooBig(bs, src, mtu); packet != nil && k.icmpLimiter.allow(icmpRate, icmpBurst) {
+				_, _ = k.writePC(packet)
 			}
+			k.drop(DropMTUExceeded, bs)
 			continue
 		}
-		var srcAddr core.Address
-		var srcSubnet core.Subnet
-		var addrlen int
-		switch {
-		case ip4:
-			copy(srcAddr[:], bs[12:16])
-			addrlen = 4
-		case ip6:
-			copy(srcAddr[:], bs[8:24])
-			addrlen = 16
-		}
-		srcKey := ed25519.PublicKey(from.(iwt.Addr))
-		info := k.update(srcKey)
-		if srcAddr != info.address && srcSubnet != info.subnet {
-			// check if it's a CKR source instead
-			if addr, ok := netip.AddrFromSlice(srcAddr[:addrlen]); ok {
-				key, err := k.ckr.getPublicKeyForAddress(addr)
-				if err != nil {
-					return 0, nil // err
-				}
-				if !key.Equal(srcKey) {
-					return 0, nil // fmt.Errorf("unknown source address")
+		k.snoopPacketTooBig(info, bs)
+		k.clampMSS(bs, srcRoute)
+		info.traffic.countRx(len(bs))
+		if srcRoute != nil {
+			srcRoute.traffic.countRx(len(bs))
+		}
+		if len(bs) > mtu {
+			// DF isn't set, so split the packet up for the TUN adapter
+			for _, frag := range fragmentIPv4(bs, mtu) {
+				if !k.deliver(readResult{packet: frag}) {
+					return
 				}
-			} else {
-				return 0, nil // fmt.Errorf("invalid source address")
 			}
+			continue
+		}
+		if !k.deliver(readResult{packet: append([]byte(nil), bs...)}) {
+			return
 		}
-		return copy(p, bs), nil
 	}
 }
 
+// Passes a packet or error to readPC, waiting for it to be read. Returns false
+// if the key store is closed first.
+func (k *keyStore) deliver(r readResult) bool {
+	select {
+	case k.reads <- r:
+		return true
+	case <-k.done:
+		return false
+	}
+}
+
+// Checks that packets with the given source address may be received from the
+// key of the given info, which is the case if it is the key's mesh address,
+// or if the key is a gateway of the crypto-key route for the address. Sources
+// in the key's mesh subnet are not accepted. Returns the route for the
+// address, or nil if it is a mesh address.
+func (k *keyStore) checkSource(src netip.Addr, info *keyInfo) (*route, error) {
+	if src.Is6() && core.Address(src.As16()) == info.address {
+		return nil, nil
+	}
+	// check if it's a CKR source instead
+	route, err := k.ckr.getRouteForAddress(src)
+	if err != nil {
+		if errors.Is(err, DropCKRDisabled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w (%v)", DropUnknownSource, err)
+	}
+	if !route.hasGateway(info.key[:]) {
+		return route, fmt.Errorf("%w: not routed to %s", DropUnknownSource, hex.EncodeToString(info.key[:]))
+	}
+	return route, nil
+}
+
+// Passes a packet that we generated, such as an ICMP error, to readPC so that
+// it is written to the TUN adapter. The packet is dropped if too many packets
+// are already waiting to be read.
+func (k *keyStore) deliverLocal(packet []byte) {
+	select {
+	case k.reads <- readResult{packet: packet}:
+	default:
+	}
+}
+
+func (k *keyStore) readPC(p []byte) (int, error) {
+	var r readResult
+	select {
+	case r = <-k.reads:
+	case <-k.done:
+		return 0, net.ErrClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) < len(r.packet) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(p, r.packet), nil
+}
+
 func (k *keyStore) writePC(bs []byte) (int, error) {
 	ip4 := bs[0]&0xf0 == 0x40
 	ip6 := bs[0]&0xf0 == 0x60
 	if !ip4 && !ip6 {
-		return 0, errors.New("not an IP packet")
+		return 0, k.drop(DropNotIP, bs)
 	}
 	if ip6 && len(bs) < 40 {
-		strErr := fmt.Sprint("undersized IPv6 packet, length: ", len(bs))
-		return 0, errors.New(strErr)
+		return 0, fmt.Errorf("%w, IPv6 length: %d", k.drop(DropUndersized, bs), len(bs))
+	}
+	if ip4 && len(bs) < 20 {
+		return 0, fmt.Errorf("%w, IPv4 length: %d", k.drop(DropUndersized, bs), len(bs))
+	}
+	// The source filter and the routing table are taken from the same state,
+	// so that the packet is handled by one configuration throughout
+	state := k.ckr.snapshot()
+	if filter := state.strictSources(); filter != nil {
+		var srcAddr netip.Addr
+		if ip4 {
+			srcAddr = netip.AddrFrom4(*(*[4]byte)(bs[12:16]))
+		} else {
+			srcAddr = netip.AddrFrom16(*(*[16]byte)(bs[8:24]))
+		}
+		if !k.isLocalSource(srcAddr) && filter.subnets.lookup(srcAddr) == nil {
+			k.sendICMPError(bs, icmpProhibited)
+			return 0, fmt.Errorf("%w: %s", k.drop(DropSourceNotLocal, bs), srcAddr)
+		}
+	}
+	// The TTL and MSS of the packet are changed on its way to the mesh, so
+	// work on a copy to leave the caller's buffer alone
+	bs = append(make([]byte, 0, len(bs)), bs...)
+	if !decrementHopLimit(bs) {
+		k.drop(DropHopLimit, bs)
+		k.sendICMPError(bs, icmpTimeExceeded)
+		return 0, nil
 	}
 	var dstAddr core.Address
 	var dstSubnet core.Subnet
@@ -318,23 +525,49 @@ func (k *keyStore) writePC(bs []byte) (int, error) {
 	}
 	switch {
 	case k.core.IsValidAddress(dstAddr):
+		k.clampMSS(bs, nil)
 		k.sendToAddress(dstAddr, bs)
 	case k.core.IsValidSubnet(dstSubnet):
+		k.clampMSS(bs, nil)
 		k.sendToSubnet(dstSubnet, bs)
 	default:
 		if addr, ok := netip.AddrFromSlice(dstAddr[:addrlen]); ok {
-			key, err := k.ckr.getPublicKeyForAddress(addr)
+			route, err := k.ckr.routeForAddress(state, addr)
 			if err != nil {
-				return 0, nil // err
+				k.drop(dropReasonFor(err, DropNoRoute), bs)
+				k.sendICMPError(bs, icmpNoRoute)
+				return 0, nil
 			}
-			return k.core.WriteTo(bs, iwt.Addr(key))
+			key := route.selectGateway(flowHash(bs)).key
+			k.clampMSS(bs, route)
+			if !k.fitsPathMTU(key, bs) {
+				k.drop(DropMTUExceeded, bs)
+				return 0, nil
+			}
+			n, err := k.writeToKey(key, bs)
+			if err == nil {
+				route.traffic.countTx(len(bs))
+			}
+			return n, err
 		}
-		return 0, nil // fmt.Errorf("invalid destination address")
+		k.drop(DropInvalidDestination, bs)
+		k.sendICMPError(bs, icmpNoRoute)
+		return 0, nil
 	}
 
 	return len(bs), nil
 }
 
+// Checks whether the given address is our own address, an address in our
+// subnet or the IPv4 address of the TUN adapter.
+func (k *keyStore) isLocalSource(addr netip.Addr) bool {
+	if addr.Is4() {
+		return addr == k.address4
+	}
+	a16 := addr.As16()
+	return core.Address(a16) == k.address || bytes.Equal(a16[:len(k.subnet)], k.subnet[:])
+}
+
 // Exported API
 
 func (k *keyStore) MaxMTU() uint64 {
@@ -379,11 +612,109 @@ func (rwc *ReadWriteCloser) Subnet() core.Subnet {
 }
 
 func (rwc *ReadWriteCloser) V4Routes() []*route {
-	return rwc.ckr.v4Routes
+	return rwc.ckr.routes().v4Routes
 }
 
 func (rwc *ReadWriteCloser) V6Routes() []*route {
-	return rwc.ckr.v6Routes
+	return rwc.ckr.routes().v6Routes
+}
+
+// Routes returns all of the active crypto-key routes, IPv6 routes first.
+func (rwc *ReadWriteCloser) Routes() []*route {
+	return rwc.ckr.routes().all()
+}
+
+// AddRoute adds a crypto-key route which tunnels traffic for the given prefix
+// to the node with the given public key. The route takes effect immediately.
+func (rwc *ReadWriteCloser) AddRoute(prefix netip.Prefix, dest ed25519.PublicKey) error {
+	return rwc.ckr.addRoute(prefix, dest)
+}
+
+// RemoveRoute removes the crypto-key route for the given prefix.
+func (rwc *ReadWriteCloser) RemoveRoute(prefix netip.Prefix) error {
+	return rwc.ckr.removeRoute(prefix)
+}
+
+// ReplaceRoutes atomically replaces all crypto-key routes with the given set
+// of prefixes and destination public keys.
+func (rwc *ReadWriteCloser) ReplaceRoutes(routes map[netip.Prefix]ed25519.PublicKey) error {
+	rs := make([]*route, 0, len(routes))
+	for prefix, dest := range routes {
+		g, err := newGateway(dest, 0)
+		if err != nil {
+			return err
+		}
+		r, err := rwc.ckr.newRoute(prefix, g)
+		if err != nil {
+			return err
+		}
+		rs = append(rs, r)
+	}
+	return rwc.ckr.replaceRoutes(rs)
+}
+
+// Reconfigure applies the given tunnel routing configuration to the running
+// node, replacing the enabled state and all crypto-key routes.
+func (rwc *ReadWriteCloser) Reconfigure(cfg *config.TunnelRoutingConfig) error {
+	if err := rwc.ckr.reconfigure(cfg); err != nil {
+		return err
+	}
+	rwc.setQueueLimits(cfg)
+	rwc.setDropLogging(cfg)
+	return nil
+}
+
+// Enabled returns whether crypto-key routing is currently enabled.
+func (rwc *ReadWriteCloser) Enabled() bool {
+	return rwc.ckr.isEnabled()
+}
+
+// CachedKeys returns the keys currently in the key store cache.
+func (rwc *ReadWriteCloser) CachedKeys() []KeyStatus {
+	return rwc.cachedKeys()
+}
+
+// PendingLookups returns the mesh destinations whose keys are being looked
+// up, or which are negatively cached because they couldn't be found.
+func (rwc *ReadWriteCloser) PendingLookups() []LookupStatus {
+	return rwc.pendingLookups()
+}
+
+// Diagnose explains how packets to and from the given address are handled:
+// which mesh address, subnet or crypto-key route it belongs to, which key
+// packets are sent to and whether that key is known, and which keys packets
+// from the address are accepted from. If from is given then it is also
+// checked whether packets from the address are accepted from that key.
+func (rwc *ReadWriteCloser) Diagnose(addr netip.Addr, from ed25519.PublicKey) Diagnosis {
+	return rwc.diagnose(addr, from)
+}
+
+// Traffic returns the number of packets and bytes sent and received through
+// each crypto-key route and with each remote key since the counters were last
+// reset. If reset is set then the counters are reset to zero as they are read.
+func (rwc *ReadWriteCloser) Traffic(reset bool) Traffic {
+	return rwc.trafficSnapshot(reset)
+}
+
+// TrafficTotals returns the number of packets and bytes sent and received
+// through each crypto-key route and with each remote key since they started
+// being counted. Unlike Traffic, the totals are not affected by resetting the
+// counters, so they only ever go up.
+func (rwc *ReadWriteCloser) TrafficTotals() Traffic {
+	return rwc.trafficTotals()
+}
+
+// Stats returns the number of packets dropped so far for each reason, along
+// with the number of keys cached and packets queued in the key store.
+func (rwc *ReadWriteCloser) Stats() Stats {
+	return rwc.stats()
+}
+
+// SetRoutesChangedHandler sets a function which will be called every time the
+// crypto-key routes change, e.g. so that the routes can be installed into the
+// system routing table.
+func (rwc *ReadWriteCloser) SetRoutesChangedHandler(handler func()) {
+	rwc.ckr.setChangedHandler(handler)
 }
 
 func (rwc *ReadWriteCloser) Read(p []byte) (n int, err error) {
@@ -395,7 +726,12 @@ func (rwc *ReadWriteCloser) Write(p []byte) (n int, err error) {
 }
 
 func (rwc *ReadWriteCloser) Close() error {
-	err := rwc.core.Close()
-	rwc.core.Stop()
+	var err error
+	rwc.closeOnce.Do(func() {
+		rwc.core.PeersChangedSignal.Disconnect(rwc.peersSlot)
+		close(rwc.done)
+		err = rwc.core.Close()
+		rwc.core.Stop()
+	})
 	return err
 }
@@ -0,0 +1,237 @@
+package ckriprwc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+// Returns a UDP packet from src to dst with a few bytes of payload.
+func testPacket(src, dst netip.Addr) []byte {
+	if src.Is4() {
+		bs := make([]byte, 20+8+4)
+		bs[0] = 0x45
+		bs[2], bs[3] = 0, byte(len(bs))
+		bs[8], bs[9] = 64, 17
+		copy(bs[12:16], src.AsSlice())
+		copy(bs[16:20], dst.AsSlice())
+		csum := ipv4Checksum(bs[:20])
+		bs[10], bs[11] = byte(csum>>8), byte(csum)
+		return bs
+	}
+	bs := make([]byte, 40+8+4)
+	bs[0] = 0x60
+	bs[4], bs[5] = 0, byte(len(bs)-40)
+	bs[6], bs[7] = 17, 64
+	copy(bs[8:24], src.AsSlice())
+	copy(bs[24:40], dst.AsSlice())
+	return bs
+}
+
+func newTestReadWriteCloser(t *testing.T, cfg *config.TunnelRoutingConfig) *ReadWriteCloser {
+	rwc := NewReadWriteCloser(newTestCore(t), cfg, log.New(io.Discard, "", 0))
+	t.Cleanup(func() { _ = rwc.Close() })
+	return rwc
+}
+
+func TestCloseTwice(t *testing.T) {
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{})
+	if err := rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rwc.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeersChangedAfterClose(t *testing.T) {
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{})
+	if err := rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Give the prober time to stop, so that nothing takes the refresh
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-rwc.ckr.refresh:
+	default:
+	}
+	rwc.core.PeersChangedSignal.Emit(nil)
+	select {
+	case <-rwc.ckr.refresh:
+		t.Error("Peers changing after closing refreshed the destinations")
+	default:
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{})
+	rwc.deliverLocal(make([]byte, 100))
+	if _, err := rwc.Read(make([]byte, 50)); err != io.ErrShortBuffer {
+		t.Errorf("Read into a short buffer returned %v", err)
+	}
+	if err := rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := rwc.Read(make([]byte, 100))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected reading after closing to fail")
+		}
+	case <-time.After(time.Second):
+		t.Error("Reading after closing didn't return")
+	}
+}
+
+func TestStrictSource(t *testing.T) {
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{
+		Enable:           true,
+		StrictSource:     true,
+		IPv4LocalSubnets: []string{"192.168.1.0/24"},
+		IPv6LocalSubnets: []string{"2001:db8:1::/48"},
+	})
+	address := rwc.Address()
+	subnet := rwc.Subnet()
+	var inSubnet [16]byte
+	copy(inSubnet[:], subnet[:])
+	inSubnet[15] = 1
+	address4 := netip.AddrFrom4([4]byte{10, address[1], address[2], address[3]>>1 + 1})
+	dst4 := netip.MustParseAddr("192.0.2.1")
+	dst6 := netip.MustParseAddr("2001:db8:ffff::1")
+
+	for src, allowed := range map[netip.Addr]bool{
+		address4:                             true,
+		address4.Next():                      false,
+		netip.MustParseAddr("192.168.1.5"):   true,
+		netip.MustParseAddr("192.168.2.5"):   false,
+		netip.AddrFrom16(address):            true,
+		netip.AddrFrom16(inSubnet):           true,
+		netip.MustParseAddr("2001:db8:1::5"): true,
+		netip.MustParseAddr("2001:db8:2::5"): false,
+	} {
+		dst := dst6
+		if src.Is4() {
+			dst = dst4
+		}
+		if rwc.isLocalSource(src) && !allowed {
+			t.Errorf("%s is a local source", src)
+		}
+		_, err := rwc.Write(testPacket(src, dst))
+		if rejected := errors.Is(err, DropSourceNotLocal); rejected == allowed {
+			t.Errorf("Packet from %s was rejected: %v, expected %v", src, rejected, !allowed)
+		}
+	}
+
+	// Any source is allowed without strict source checking
+	if err := rwc.Reconfigure(&config.TunnelRoutingConfig{Enable: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.Write(testPacket(netip.MustParseAddr("192.168.2.5"), dst4)); err != nil {
+		t.Errorf("Packet was rejected without strict source checking: %v", err)
+	}
+}
+
+func TestWriteHopLimit(t *testing.T) {
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{})
+	address := rwc.Address()
+	src := netip.AddrFrom16(address)
+	dst := netip.MustParseAddr("2001:db8::1")
+	packet := testPacket(src, dst)
+	original := append([]byte(nil), packet...)
+	if _, err := rwc.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, original) {
+		t.Error("Write changed the caller's buffer")
+	}
+	bs := make([]byte, 1500)
+	if n, err := rwc.Read(bs); err != nil || n < 48 || bs[40] != 1 {
+		t.Fatal("Expected a destination unreachable message")
+	}
+
+	packet[7] = 1
+	original = append(original[:0], packet...)
+	if _, err := rwc.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	if rwc.drops[DropHopLimit] != 1 {
+		t.Fatal("Expected the packet to be dropped")
+	}
+	n, err := rwc.Read(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The time exceeded message quotes the packet as it was written
+	if quoted := bs[48:n]; n < 48 || bs[40] != 3 || !bytes.Equal(quoted, original) {
+		t.Error("Expected a time exceeded message quoting the packet")
+	}
+}
+
+// Returns the key info that the key store would create for the given key.
+func testKeyInfo(k *keyStore, key ed25519.PublicKey) *keyInfo {
+	info := &keyInfo{
+		address: *k.core.AddrForKey(key),
+		subnet:  *k.core.SubnetForKey(key),
+	}
+	copy(info.key[:], key)
+	return info
+}
+
+func TestCheckSource(t *testing.T) {
+	keyA, hexA := testKey(t)
+	keyB, _ := testKey(t)
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.1.0.0/16": hexA},
+	})
+	infoA, infoB := testKeyInfo(&rwc.keyStore, keyA), testKeyInfo(&rwc.keyStore, keyB)
+	inSubnet := infoA.subnet
+	var subnetAddr [16]byte
+	copy(subnetAddr[:], inSubnet[:])
+	subnetAddr[15] = 1
+
+	for _, tc := range []struct {
+		name  string
+		src   netip.Addr
+		info  *keyInfo
+		route bool
+		err   error
+	}{
+		{"mesh address", netip.AddrFrom16(infoA.address), infoA, false, nil},
+		{"mesh address of another key", netip.AddrFrom16(infoA.address), infoB, false, DropUnknownSource},
+		{"mesh subnet", netip.AddrFrom16(subnetAddr), infoA, false, DropUnknownSource},
+		{"CKR gateway", netip.MustParseAddr("10.1.2.3"), infoA, true, nil},
+		{"wrong key", netip.MustParseAddr("10.1.2.3"), infoB, true, DropUnknownSource},
+		{"no route", netip.MustParseAddr("10.2.2.3"), infoA, false, DropUnknownSource},
+	} {
+		route, err := rwc.checkSource(tc.src, tc.info)
+		if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+			t.Errorf("%s: got error %v, expected %v", tc.name, err, tc.err)
+		}
+		if (route != nil) != tc.route {
+			t.Errorf("%s: got route %v", tc.name, route)
+		}
+	}
+
+	if err := rwc.Reconfigure(&config.TunnelRoutingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.checkSource(netip.MustParseAddr("10.1.2.3"), infoA); !errors.Is(err, DropCKRDisabled) {
+		t.Errorf("Expected CKR source to be dropped with CKR disabled, got %v", err)
+	}
+	if _, err := rwc.checkSource(netip.AddrFrom16(infoA.address), infoA); err != nil {
+		t.Errorf("Expected mesh address to be accepted with CKR disabled, got %v", err)
+	}
+}
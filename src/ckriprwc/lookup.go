@@ -0,0 +1,93 @@
+package ckriprwc
+
+// The lookup module keeps track of the key lookups for mesh destinations. Only
+// one lookup is in flight for each destination at a time, and it is retried
+// with exponential backoff until it is answered or has been sent too many
+// times. A destination which never answers is negatively cached for a while,
+// during which packets to it are rejected straight away with an ICMPv6
+// destination unreachable message instead of being queued.
+
+import (
+	"crypto/ed25519"
+	"time"
+)
+
+const (
+	lookupRetryMin  = time.Second      // How long to wait for the first lookup to be answered
+	lookupRetryMax  = 8 * time.Second  // Upper bound on the time between lookups
+	lookupAttempts  = 5                // How many lookups are sent before giving up
+	unreachableTime = 30 * time.Second // How long a destination is negatively cached for
+)
+
+// Checks whether the destination of the buffer is negatively cached.
+func (buf *buffer) isUnreachable() bool {
+	return time.Now().Before(buf.unreachable)
+}
+
+// Stops the timers of a buffer which is being removed.
+func (buf *buffer) stop() {
+	if buf.timeout != nil {
+		buf.timeout.Stop()
+	}
+	if buf.retry != nil {
+		buf.retry.Stop()
+		buf.retry = nil
+	}
+}
+
+// Starts looking up the key for the destination of the buffer, unless a lookup
+// is already in flight. The current function reports whether buf is still the
+// buffer for the destination. Returns whether a lookup should be sent now. The
+// caller must hold k.mutex.
+func (k *keyStore) _startLookup(buf *buffer, partial ed25519.PublicKey, current func() bool) bool {
+	if buf.retry != nil {
+		return false
+	}
+	buf.lookups = 1
+	k._scheduleRetry(buf, partial, current)
+	return true
+}
+
+// Returns how long to wait for the given lookup to be answered, counting from
+// the first lookup sent for a destination.
+func lookupDelay(lookups int) time.Duration {
+	delay := lookupRetryMin << (lookups - 1)
+	if delay > lookupRetryMax {
+		delay = lookupRetryMax
+	}
+	return delay
+}
+
+// Schedules the next lookup for the destination of the buffer. The caller must
+// hold k.mutex.
+func (k *keyStore) _scheduleRetry(buf *buffer, partial ed25519.PublicKey, current func() bool) {
+	buf.retry = time.AfterFunc(lookupDelay(buf.lookups), func() {
+		k.retryLookup(buf, partial, current)
+	})
+}
+
+// Sends the next lookup for the destination of the buffer once the last one
+// has gone unanswered, or negatively caches the destination if enough lookups
+// have been sent already.
+func (k *keyStore) retryLookup(buf *buffer, partial ed25519.PublicKey, current func() bool) {
+	k.mutex.Lock()
+	if !current() || buf.retry == nil {
+		k.mutex.Unlock()
+		return
+	}
+	if buf.lookups >= lookupAttempts {
+		buf.retry = nil
+		buf.unreachable = time.Now().Add(unreachableTime)
+		packets := k._dequeue(buf)
+		k.mutex.Unlock()
+		for _, packet := range packets {
+			k.drop(DropUnreachable, packet)
+			k.sendICMPError(packet, icmpAddressUnreachable)
+		}
+		return
+	}
+	buf.lookups++
+	k._scheduleRetry(buf, partial, current)
+	k.mutex.Unlock()
+	k.sendKeyLookup(partial)
+}
@@ -0,0 +1,78 @@
+package ckriprwc
+
+import (
+	"crypto/ed25519"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/RiV-chain/RiV-mesh/src/core"
+)
+
+func TestLookupDelay(t *testing.T) {
+	for lookups, want := range map[int]time.Duration{
+		1: lookupRetryMin,
+		2: 2 * lookupRetryMin,
+		3: 4 * lookupRetryMin,
+		4: lookupRetryMax,
+		5: lookupRetryMax,
+	} {
+		if delay := lookupDelay(lookups); delay != want {
+			t.Errorf("Lookup %d waits %s, expected %s", lookups, delay, want)
+		}
+	}
+}
+
+func TestLookupNegativeCache(t *testing.T) {
+	k := &keyStore{
+		core:        newTestCore(t),
+		addrToInfo:  make(map[core.Address]*keyInfo),
+		addrBuffer:  make(map[core.Address]*buffer),
+		queueLimits: queueLimits{packets: 4, bytes: 1024, memory: 1024},
+	}
+	var addr core.Address
+	addr[0], addr[15] = 0xfc, 1
+	packet := testPacket(netip.MustParseAddr("fc00::2"), netip.AddrFrom16(addr))
+	partial := ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))
+	current := func() bool { return true }
+
+	buf := new(buffer)
+	k.addrBuffer[addr] = buf
+	k.mutex.Lock()
+	k._enqueue(buf, packet)
+	first := k._startLookup(buf, partial, current)
+	second := k._startLookup(buf, partial, current)
+	k.mutex.Unlock()
+	defer buf.stop()
+	if !first || second {
+		t.Fatal("Expected only one lookup to be in flight at a time")
+	}
+	for i := 2; i <= lookupAttempts; i++ {
+		// Fire the retry straight away instead of waiting for the timer
+		buf.retry.Stop()
+		k.retryLookup(buf, partial, current)
+		if buf.lookups != i || buf.isUnreachable() {
+			t.Fatalf("Sent %d lookups, expected %d", buf.lookups, i)
+		}
+	}
+	buf.retry.Stop()
+	k.retryLookup(buf, partial, current)
+	if buf.retry != nil || !buf.isUnreachable() {
+		t.Fatal("Expected the destination to be negatively cached")
+	}
+	if len(buf.packets) != 0 || k.queued != 0 || k.drops[DropUnreachable] != 1 {
+		t.Errorf("Expected the queued packet to be dropped, %d are still queued", len(buf.packets))
+	}
+
+	// Packets to a negatively cached destination are dropped straight away
+	k.sendToAddress(addr, packet)
+	if len(buf.packets) != 0 || k.drops[DropUnreachable] != 2 {
+		t.Error("Expected a packet to a negatively cached destination to be dropped")
+	}
+	k.mutex.Lock()
+	lookup := k._startLookup(buf, partial, current)
+	k.mutex.Unlock()
+	if !lookup || buf.lookups != 1 {
+		t.Error("Expected lookups to start over")
+	}
+}
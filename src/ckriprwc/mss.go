@@ -0,0 +1,117 @@
+package ckriprwc
+
+// The MSS module optionally clamps the maximum segment size announced in TCP
+// SYN and SYN-ACK segments passing through in either direction, so that TCP
+// connections work across paths where path MTU discovery is broken. The MSS is
+// derived from the MTU of the TUN adapter, unless a value is configured for
+// the crypto-key route that the segment uses.
+
+import "encoding/binary"
+
+const (
+	tcpOptionEnd = 0
+	tcpOptionNop = 1
+	tcpOptionMSS = 2
+)
+
+// Returns the TCP header of the given IP packet if it is a SYN or SYN-ACK
+// segment, along with the combined length of the IP and TCP headers without
+// options. Returns nil for anything else, including fragments and IPv6
+// packets with extension headers.
+func synSegment(bs []byte) ([]byte, int) {
+	var tcp []byte
+	var overhead int
+	switch {
+	case len(bs) >= 20 && bs[0]&0xf0 == 0x40:
+		ihl := int(bs[0]&0x0f) * 4
+		if bs[9] != 6 || binary.BigEndian.Uint16(bs[6:8])&0x1fff != 0 || ihl < 20 || len(bs) < ihl {
+			return nil, 0
+		}
+		tcp, overhead = bs[ihl:], 40
+	case len(bs) >= 40 && bs[0]&0xf0 == 0x60:
+		if bs[6] != 6 {
+			return nil, 0
+		}
+		tcp, overhead = bs[40:], 60
+	default:
+		return nil, 0
+	}
+	if len(tcp) < 20 || tcp[13]&0x02 == 0 {
+		return nil, 0
+	}
+	doff := int(tcp[12]>>4) * 4
+	if doff < 20 || len(tcp) < doff {
+		return nil, 0
+	}
+	return tcp[:doff], overhead
+}
+
+// Updates a ones' complement checksum for a 16-bit word of the checksummed
+// data changing from old to new, see RFC 1624.
+func checksumUpdate(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = (s & 0xffff) + (s >> 16)
+	s = (s & 0xffff) + (s >> 16)
+	return ^uint16(s)
+}
+
+// Lowers the MSS option of the given TCP header to at most mss, updating the
+// TCP checksum. Returns whether the header was changed.
+func setMSS(tcp []byte, mss uint16) bool {
+	for i := 20; i < len(tcp); {
+		switch tcp[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNop:
+			i++
+			continue
+		}
+		if i+1 >= len(tcp) || tcp[i+1] < 2 || i+int(tcp[i+1]) > len(tcp) {
+			return false
+		}
+		if tcp[i] == tcpOptionMSS && tcp[i+1] == 4 {
+			off := i + 2
+			if binary.BigEndian.Uint16(tcp[off:off+2]) <= mss {
+				return false
+			}
+			// The option isn't necessarily aligned to a 16-bit word, so
+			// update the checksum for every word that it overlaps
+			start, end := off&^1, (off+3)&^1
+			old := make([]byte, end-start)
+			copy(old, tcp[start:])
+			binary.BigEndian.PutUint16(tcp[off:off+2], mss)
+			sum := binary.BigEndian.Uint16(tcp[16:18])
+			for w := start; w < end; w += 2 {
+				oldWord := uint16(old[w-start]) << 8
+				newWord := uint16(tcp[w]) << 8
+				if w+1 < len(tcp) {
+					oldWord |= uint16(old[w-start+1])
+					newWord |= uint16(tcp[w+1])
+				}
+				sum = checksumUpdate(sum, oldWord, newWord)
+			}
+			binary.BigEndian.PutUint16(tcp[16:18], sum)
+			return true
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
+
+// Clamps the MSS of the given packet in place if it is a TCP SYN or SYN-ACK
+// segment and MSS clamping is enabled. The given route is the crypto-key
+// route that the packet uses, or nil if it is sent to or from a mesh address.
+func (k *keyStore) clampMSS(bs []byte, r *route) {
+	if !k.ckr.isClampingMSS() {
+		return
+	}
+	tcp, overhead := synSegment(bs)
+	if tcp == nil {
+		return
+	}
+	mss := int(k.MTU()) - overhead
+	if r != nil && r.mss != 0 {
+		mss = int(r.mss)
+	}
+	setMSS(tcp, uint16(mss))
+}
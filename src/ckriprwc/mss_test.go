@@ -0,0 +1,80 @@
+package ckriprwc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+// Returns an IPv4 TCP SYN segment with the given options, with a valid TCP
+// checksum.
+func synPacket(t *testing.T, options []byte) []byte {
+	tcp := make([]byte, 20, 20+len(options))
+	tcp = append(tcp, options...)
+	tcp[12] = byte(len(tcp)/4) << 4
+	tcp[13] = 0x02 // SYN
+	header, err := ipv4Header_Marshal(&ipv4.Header{
+		TotalLen: ipv4.HeaderLen + len(tcp),
+		TTL:      64,
+		Protocol: 6,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(10, 1, 2, 3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(header, tcp))
+	return append(header, tcp...)
+}
+
+func tcpChecksum(header, tcp []byte) uint16 {
+	pseudo := make([]byte, 12, 12+len(tcp))
+	copy(pseudo[0:8], header[12:20])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	return ipv4Checksum(append(pseudo, tcp...))
+}
+
+func TestSetMSS(t *testing.T) {
+	for name, options := range map[string][]byte{
+		"aligned":   {2, 4, 0x05, 0xb4, 1, 1, 1, 0},
+		"unaligned": {1, 2, 4, 0x05, 0xb4, 1, 1, 0},
+	} {
+		packet := synPacket(t, options)
+		tcp, overhead := synSegment(packet)
+		if tcp == nil || overhead != 40 {
+			t.Fatalf("%s: SYN segment not found", name)
+		}
+		if !setMSS(tcp, 1240) {
+			t.Fatalf("%s: MSS was not clamped", name)
+		}
+		if tcpChecksum(packet[:20], tcp) != 0 {
+			t.Errorf("%s: TCP checksum is wrong after clamping", name)
+		}
+		if setMSS(tcp, 1300) {
+			t.Errorf("%s: MSS was raised", name)
+		}
+	}
+}
+
+func TestClampMSSOnWrite(t *testing.T) {
+	_, hexKey := testKey(t)
+	rwc := newTestReadWriteCloser(t, &config.TunnelRoutingConfig{
+		Enable:            true,
+		ClampMSS:          true,
+		IPv4RemoteSubnets: map[string]string{"10.0.0.0/8": hexKey},
+	})
+	packet := synPacket(t, []byte{2, 4, 0xff, 0xff})
+	original := append([]byte(nil), packet...)
+	if _, err := rwc.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, original) {
+		t.Error("Clamping the MSS changed the caller's buffer")
+	}
+}
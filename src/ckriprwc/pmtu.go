@@ -0,0 +1,162 @@
+package ckriprwc
+
+// The PMTU module handles path MTU discovery across the mesh. Packets which
+// are too big for the receiving node are answered with an ICMPv6 Packet Too
+// Big or an ICMP Fragmentation Needed message, and those messages are watched
+// for on the way back so that the path MTU to each destination key is learned.
+// Larger packets to that key are then answered locally instead of being sent
+// across the mesh to be dropped. Learned path MTUs are forgotten after a while
+// so that a path which has grown is used again.
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	pmtuTimeout = 10 * time.Minute // How long a learned path MTU is kept, as suggested by RFC 8201
+	minPMTU     = 1280             // The smallest MTU allowed on the mesh
+)
+
+type pmtuEntry struct {
+	mtu     int
+	expires time.Time
+}
+
+// The learned path MTUs, mapped by destination key.
+type pmtuCache struct {
+	entries sync.Map // keyArray -> pmtuEntry
+}
+
+// Returns the learned path MTU to the given key, or 0 if there is none.
+func (p *pmtuCache) get(key keyArray) int {
+	if v, ok := p.entries.Load(key); ok {
+		if entry := v.(pmtuEntry); time.Now().Before(entry.expires) {
+			return entry.mtu
+		}
+	}
+	return 0
+}
+
+// Records that the path to the given key supports at most the given MTU.
+func (p *pmtuCache) learn(key keyArray, mtu int) {
+	if mtu < minPMTU {
+		mtu = minPMTU
+	}
+	if current := p.get(key); current != 0 && current < mtu {
+		mtu = current
+	}
+	p.entries.Store(key, pmtuEntry{mtu: mtu, expires: time.Now().Add(pmtuTimeout)})
+}
+
+// Forgets the path MTUs which have expired.
+func (p *pmtuCache) expire() {
+	now := time.Now()
+	p.entries.Range(func(key, v interface{}) bool {
+		if now.After(v.(pmtuEntry).expires) {
+			p.entries.Delete(key)
+		}
+		return true
+	})
+}
+
+// Returns an ICMPv6 Packet Too Big or ICMP Fragmentation Needed message from
+// src, telling the sender of the given packet to use the given MTU. Returns
+// nil if no message should be sent, e.g. for an IPv4 packet which is allowed
+// to be fragmented.
+func createPacketTooBig(bs []byte, src net.IP, mtu int) []byte {
+	switch {
+	case len(bs) >= ipv6.HeaderLen && bs[0]&0xf0 == 0x60:
+		if !shouldSendICMPv6Error(bs) {
+			return nil
+		}
+		// Quote as much of the packet as fits into the minimum IPv6 MTU
+		data := make([]byte, 1280-ipv6.HeaderLen-8)
+		data = data[:copy(data, bs)]
+		ptb := &icmp.PacketTooBig{
+			MTU:  mtu,
+			Data: data,
+		}
+		if packet, err := CreateICMPv6(data[8:24], src, ipv6.ICMPTypePacketTooBig, 0, ptb); err == nil {
+			return packet
+		}
+	case len(bs) >= ipv4.HeaderLen && bs[0]&0xf0 == 0x40:
+		if bs[6]&0x40 == 0 || !shouldSendICMPv4Error(bs) {
+			return nil // DF isn't set
+		}
+		// The next-hop MTU goes into the second half of the otherwise unused
+		// field of the destination unreachable message, see RFC 1191
+		body := make([]byte, 576-ipv4.HeaderLen-8+4)
+		binary.BigEndian.PutUint16(body[2:4], uint16(mtu))
+		body = body[:4+copy(body[4:], bs)]
+		frag := &icmp.RawBody{Data: body}
+		if packet, err := CreateICMPv4(body[4+12:4+16], src, ipv4.ICMPTypeDestinationUnreachable, 4, frag); err == nil {
+			return packet
+		}
+	}
+	return nil
+}
+
+// Checks whether the given packet from the TUN adapter fits into the learned
+// path MTU to the given key. If it doesn't then the sender is told to use a
+// smaller MTU and false is returned.
+func (k *keyStore) fitsPathMTU(key ed25519.PublicKey, bs []byte) bool {
+	var dest keyArray
+	copy(dest[:], key)
+	mtu := k.pmtu.get(dest)
+	if mtu == 0 || len(bs) <= mtu {
+		return true
+	}
+	if bs[0]&0xf0 == 0x40 && bs[6]&0x40 == 0 {
+		return true // DF isn't set, so the packet may still be fragmented
+	}
+	var src net.IP
+	if bs[0]&0xf0 == 0x40 {
+		src = k.address4.AsSlice()
+	} else {
+		src = net.IP(append([]byte(nil), k.address[:]...))
+	}
+	if packet := createPacketTooBig(bs, src, mtu); packet != nil && k.icmpLimiter.allow(icmpRate, icmpBurst) {
+		k.deliverLocal(packet)
+	}
+	return false
+}
+
+// Learns the path MTU to the key of the given info if the given packet received
+// from it is an ICMPv6 Packet Too Big or ICMP Fragmentation Needed message
+// about a packet which we would have sent to that key.
+func (k *keyStore) snoopPacketTooBig(info *keyInfo, bs []byte) {
+	var mtu int
+	var dst netip.Addr
+	switch {
+	case bs[0]&0xf0 == 0x60:
+		if len(bs) < ipv6.HeaderLen+8+ipv6.HeaderLen || bs[6] != 58 || bs[ipv6.HeaderLen] != byte(ipv6.ICMPTypePacketTooBig) {
+			return
+		}
+		mtu = int(binary.BigEndian.Uint32(bs[ipv6.HeaderLen+4 : ipv6.HeaderLen+8]))
+		quoted := bs[ipv6.HeaderLen+8:]
+		dst = netip.AddrFrom16(*(*[16]byte)(quoted[24:40]))
+	case bs[0]&0xf0 == 0x40:
+		ihl := int(bs[0]&0x0f) * 4
+		if len(bs) < ihl+8+ipv4.HeaderLen || bs[9] != 1 || bs[ihl] != byte(ipv4.ICMPTypeDestinationUnreachable) || bs[ihl+1] != 4 {
+			return
+		}
+		mtu = int(binary.BigEndian.Uint16(bs[ihl+6 : ihl+8]))
+		dst = netip.AddrFrom4(*(*[4]byte)(bs[ihl+8+16 : ihl+8+20]))
+	default:
+		return
+	}
+	// Packets to the quoted destination are sent to the key if packets from
+	// it would be accepted from the key
+	if _, err := k.checkSource(dst, info); mtu != 0 && err == nil {
+		k.pmtu.learn(info.key, mtu)
+	}
+}
@@ -0,0 +1,63 @@
+package ckriprwc
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+func TestPacketTooBigLearning(t *testing.T) {
+	original, err := ipv4Header_Marshal(&ipv4.Header{
+		TotalLen: 1400,
+		Flags:    ipv4.DontFragment,
+		TTL:      64,
+		Protocol: 6,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(10, 1, 2, 3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	original = append(original, make([]byte, 1380)...)
+	packet := createPacketTooBig(original, net.IPv4(10, 1, 2, 3), 1300)
+	if packet == nil {
+		t.Fatal("Expected a fragmentation needed message")
+	}
+
+	pub, hexKey := testKey(t)
+	other, _ := testKey(t)
+	ckr := newTestCryptokey(t, &config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.0.0.0/8": hexKey},
+	})
+	k := &keyStore{core: ckr.core, ckr: ckr}
+	info := &keyInfo{address: *ckr.core.AddrForKey(pub), subnet: *ckr.core.SubnetForKey(pub)}
+	copy(info.key[:], pub)
+	key := info.key
+	otherInfo := &keyInfo{address: *ckr.core.AddrForKey(other), subnet: *ckr.core.SubnetForKey(other)}
+	copy(otherInfo.key[:], other)
+	k.snoopPacketTooBig(otherInfo, packet)
+	if mtu := k.pmtu.get(otherInfo.key); mtu != 0 {
+		t.Fatal("Learned a path MTU from a key which 10.1.2.3 isn't routed to")
+	}
+	k.snoopPacketTooBig(info, packet)
+	if mtu := k.pmtu.get(key); mtu != 1300 {
+		t.Fatalf("Learned path MTU %d, expected 1300", mtu)
+	}
+	k.pmtu.learn(key, 1400)
+	if mtu := k.pmtu.get(key); mtu != 1300 {
+		t.Errorf("Path MTU grew to %d before expiring", mtu)
+	}
+	k.pmtu.learn(key, 576)
+	if mtu := k.pmtu.get(key); mtu != minPMTU {
+		t.Errorf("Path MTU shrank to %d, below the mesh minimum", mtu)
+	}
+
+	original[6] &^= 0x40
+	if createPacketTooBig(original, net.IPv4(10, 1, 2, 3), 1300) != nil {
+		t.Error("Expected no message for a packet without DF set")
+	}
+}
@@ -0,0 +1,81 @@
+package ckriprwc
+
+// The queue module holds the packets sent to a mesh address or subnet while
+// the key for it is being looked up. Each pending destination has a FIFO queue
+// bounded by a number of packets and bytes, and the total queued across all
+// destinations is capped too. Packets which would exceed any of the limits are
+// dropped and counted, and the queue is flushed in order once the key is known.
+
+import (
+	"time"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+const (
+	defaultQueuePackets = 32
+	defaultQueueBytes   = 64 * 1024
+	defaultQueueMemory  = 4 * 1024 * 1024
+)
+
+// The packets queued for a destination whose key is being looked up.
+type buffer struct {
+	packets     [][]byte
+	size        int         // The total length of the queued packets
+	timeout     *time.Timer // From calling a time.AfterFunc to do cleanup
+	expires     time.Time   // When the timeout fires
+	lookups     int         // The number of lookups sent without an answer
+	retry       *time.Timer // Sends the next lookup, nil if no lookup is in flight
+	unreachable time.Time   // Until when the destination is negatively cached
+}
+
+type queueLimits struct {
+	packets int // Maximum number of packets queued for each destination
+	bytes   int // Maximum number of bytes queued for each destination
+	memory  int // Maximum number of bytes queued across all destinations
+}
+
+// Sets the queue limits from the given configuration, using the defaults for
+// any which are not set.
+func (k *keyStore) setQueueLimits(cfg *config.TunnelRoutingConfig) {
+	limits := queueLimits{
+		packets: cfg.PendingQueuePackets,
+		bytes:   cfg.PendingQueueBytes,
+		memory:  cfg.PendingQueueMemory,
+	}
+	if limits.packets <= 0 {
+		limits.packets = defaultQueuePackets
+	}
+	if limits.bytes <= 0 {
+		limits.bytes = defaultQueueBytes
+	}
+	if limits.memory <= 0 {
+		limits.memory = defaultQueueMemory
+	}
+	k.mutex.Lock()
+	k.queueLimits = limits
+	k.mutex.Unlock()
+}
+
+// Appends a copy of the packet to the queue, unless that would exceed the
+// limits of the queue or the total queued across all destinations, in which
+// case the packet is dropped. The caller must hold k.mutex.
+func (k *keyStore) _enqueue(buf *buffer, bs []byte) {
+	limits := k.queueLimits
+	if len(buf.packets) >= limits.packets || buf.size+len(bs) > limits.bytes || k.queued+len(bs) > limits.memory {
+		k.drop(DropQueueFull, bs)
+		return
+	}
+	buf.packets = append(buf.packets, append([]byte(nil), bs...))
+	buf.size += len(bs)
+	k.queued += len(bs)
+}
+
+// Empties the queue, returning the packets that were queued in the order they
+// were queued. The caller must hold k.mutex.
+func (k *keyStore) _dequeue(buf *buffer) [][]byte {
+	packets := buf.packets
+	k.queued -= buf.size
+	buf.packets, buf.size = nil, 0
+	return packets
+}
@@ -0,0 +1,28 @@
+package ckriprwc
+
+import "testing"
+
+func TestQueueLimits(t *testing.T) {
+	k := &keyStore{queueLimits: queueLimits{packets: 3, bytes: 250, memory: 300}}
+	a, b := new(buffer), new(buffer)
+	for i := 0; i < 4; i++ {
+		k._enqueue(a, []byte{byte(i)})
+	}
+	if len(a.packets) != 3 || k.drops[DropQueueFull] != 1 {
+		t.Fatalf("Queued %d packets and dropped %d, expected 3 and 1", len(a.packets), k.drops[DropQueueFull])
+	}
+	for i, packet := range a.packets {
+		if packet[0] != byte(i) {
+			t.Errorf("Packet %d is out of order", i)
+		}
+	}
+	k._enqueue(b, make([]byte, 251))
+	k._enqueue(b, make([]byte, 200))
+	k._enqueue(b, make([]byte, 98))
+	if len(b.packets) != 1 || k.queued != 203 || k.drops[DropQueueFull] != 3 {
+		t.Fatalf("Queued %d packets of %d bytes and dropped %d, expected 1, 203 and 3", len(b.packets), k.queued, k.drops[DropQueueFull])
+	}
+	if packets := k._dequeue(a); len(packets) != 3 || k.queued != 200 {
+		t.Errorf("Dequeued %d packets leaving %d bytes queued, expected 3 and 200", len(packets), k.queued)
+	}
+}
@@ -0,0 +1,188 @@
+package ckriprwc
+
+// The reachability module tracks whether the destination of each crypto-key
+// route is currently answering. Routes are installed as soon as they are
+// configured, but traffic can only pass once the remote node is reachable
+// across the mesh, so each destination key is probed with key lookups and
+// marked reachable whenever it answers or sends us traffic.
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	probeTick     = 5 * time.Second  // How often destination states are evaluated
+	probeInterval = 30 * time.Second // How long a destination stays reachable without being heard from
+	probeTimeout  = 10 * time.Second // How long to wait for a probe to be answered
+)
+
+// RouteState describes whether a crypto-key route is able to pass traffic.
+type RouteState int32
+
+const (
+	RoutePending     RouteState = iota // No peers are connected, or the destination has not answered yet
+	RouteReachable                     // The destination has recently answered a lookup or sent traffic
+	RouteUnreachable                   // The destination did not answer a lookup in time
+)
+
+func (s RouteState) String() string {
+	switch s {
+	case RoutePending:
+		return "pending"
+	case RouteReachable:
+		return "reachable"
+	case RouteUnreachable:
+		return "unreachable"
+	}
+	return "unknown"
+}
+
+func (s RouteState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// The reachability of a single destination key, shared by all routes which
+// tunnel to that key. All fields are accessed atomically.
+type keyState struct {
+	key       keyArray
+	state     int32 // RouteState
+	lastSeen  int64 // Unix nanoseconds of the last response or received traffic
+	lastProbe int64 // Unix nanoseconds of the last lookup sent
+}
+
+func (s *keyState) getState() RouteState {
+	return RouteState(atomic.LoadInt32(&s.state))
+}
+
+func (s *keyState) getLastSeen() time.Time {
+	if seen := atomic.LoadInt64(&s.lastSeen); seen != 0 {
+		return time.Unix(0, seen)
+	}
+	return time.Time{}
+}
+
+// Stores the given routing table and rebuilds the set of tracked destination
+// keys from it. Routes which have not been published before are given the
+// existing state for their destination key, if there is one. The caller must
+// hold c.mutex.
+func (c *cryptokey) _storeTable(table *routeTable) {
+	next := *c.snapshot()
+	c._storeState(&next, table)
+}
+
+// Publishes the given state with the given routing table, rebuilding the set
+// of tracked destination keys as _storeTable does. The caller must hold
+// c.mutex.
+func (c *cryptokey) _storeState(next *ckrState, table *routeTable) {
+	old := c.keyStates()
+	states := make(map[keyArray]*keyState)
+	for _, r := range table.all() {
+		for _, g := range r.gateways {
+			if g.reach == nil {
+				var key keyArray
+				copy(key[:], g.key)
+				if g.reach = states[key]; g.reach == nil {
+					if g.reach = old[key]; g.reach == nil {
+						g.reach = &keyState{key: key}
+					}
+				}
+			}
+			states[g.reach.key] = g.reach
+		}
+	}
+	next.table = table
+	next.reach = states
+	c.state.Store(next)
+	c.refreshNow()
+}
+
+// Returns all of the tracked destination keys. The returned map must not be
+// modified.
+func (c *cryptokey) keyStates() map[keyArray]*keyState {
+	return c.snapshot().reach
+}
+
+// Moves the given destination into a new state, logging the change.
+func (c *cryptokey) setKeyState(s *keyState, state RouteState) {
+	if old := RouteState(atomic.SwapInt32(&s.state, int32(state))); old != state {
+		c.log.Infof("CKR destination %s is now %s (was %s)", hex.EncodeToString(s.key[:]), state, old)
+	}
+}
+
+// Records that the given key has answered a lookup or sent us traffic.
+func (c *cryptokey) markSeen(key keyArray) {
+	if s := c.keyStates()[key]; s != nil {
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+		c.setKeyState(s, RouteReachable)
+	}
+}
+
+// Requests that all destinations are evaluated straight away, e.g. because
+// the set of connected peers has changed.
+func (c *cryptokey) refreshNow() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Evaluates and probes the CKR destinations, solicits routes from the trusted
+// announcers and fetches routing tables from the route controllers, until the
+// key store is closed.
+func (k *keyStore) prober() {
+	ticker := time.NewTicker(probeTick)
+	defer ticker.Stop()
+	var lastSolicit, lastFetch time.Time
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+		case <-k.ckr.refresh:
+		}
+		k.probeDestinations()
+		k.ckr.expireLearned()
+		k.pmtu.expire()
+		k.frags.expire()
+		k.pruneTraffic()
+		if time.Since(lastSolicit) >= advertInterval && len(k.core.GetPeers()) > 0 {
+			lastSolicit = time.Now()
+			k.solicitRoutes()
+		}
+		if time.Since(lastFetch) >= controllerInterval && len(k.core.GetPeers()) > 0 {
+			lastFetch = time.Now()
+			k.requestTables()
+		}
+	}
+}
+
+// Evaluates the state of every CKR destination key, sending lookups to the
+// destinations which have not been heard from recently.
+func (k *keyStore) probeDestinations() {
+	if !k.ckr.isEnabled() {
+		return
+	}
+	hasPeers := len(k.core.GetPeers()) > 0
+	now := time.Now().UnixNano()
+	for _, s := range k.ckr.keyStates() {
+		if !hasPeers {
+			atomic.StoreInt64(&s.lastProbe, 0)
+			k.ckr.setKeyState(s, RoutePending)
+			continue
+		}
+		lastSeen := atomic.LoadInt64(&s.lastSeen)
+		lastProbe := atomic.LoadInt64(&s.lastProbe)
+		switch {
+		case now-lastSeen < int64(probeInterval):
+			k.ckr.setKeyState(s, RouteReachable)
+		case lastProbe <= lastSeen || now-lastProbe >= int64(probeInterval):
+			atomic.StoreInt64(&s.lastProbe, now)
+			k.sendKeyLookup(ed25519.PublicKey(s.key[:]))
+		case now-lastProbe >= int64(probeTimeout):
+			k.ckr.setKeyState(s, RouteUnreachable)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package ckriprwc
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+func TestRouteFailover(t *testing.T) {
+	keyA, hexA := testKey(t)
+	keyB, hexB := testKey(t)
+	cfg := &config.TunnelRoutingConfig{
+		Enable: true,
+		IPv4RemoteGateways: map[string][]config.RemoteGateway{
+			"10.0.0.0/8": {{PublicKey: hexB, Priority: 1}, {PublicKey: hexA, Priority: 0}},
+		},
+	}
+	ckr := newTestCryptokey(t, cfg)
+	r := ckr.routes().get(netip.MustParsePrefix("10.0.0.0/8"))
+	if r == nil {
+		t.Fatal("Route wasn't installed")
+	}
+	if r.State() != RoutePending || !r.Destination().Equal(keyA) {
+		t.Fatalf("New route is %s to %x, expected pending to the preferred gateway", r.State(), r.Destination())
+	}
+
+	var a, b keyArray
+	copy(a[:], keyA)
+	copy(b[:], keyB)
+	ckr.markSeen(b)
+	if r.State() != RouteReachable || !r.Destination().Equal(keyB) {
+		t.Error("Expected the reachable gateway to be used over the pending one")
+	}
+	ckr.markSeen(a)
+	if !r.Destination().Equal(keyA) || r.LastSeen().IsZero() {
+		t.Error("Expected the preferred gateway to be used once it is reachable")
+	}
+	ckr.setKeyState(ckr.keyStates()[a], RouteUnreachable)
+	if !r.Destination().Equal(keyB) {
+		t.Error("Expected failover to the other gateway")
+	}
+
+	// The states are kept when the table is replaced
+	if err := ckr.reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	r = ckr.routes().get(netip.MustParsePrefix("10.0.0.0/8"))
+	if gateways := r.Gateways(); gateways[0].State != RouteUnreachable || gateways[1].State != RouteReachable {
+		t.Errorf("Gateway states %s and %s weren't kept", gateways[0].State, gateways[1].State)
+	}
+
+	// Without any peers, nothing can be reached
+	k := &keyStore{core: ckr.core, ckr: ckr}
+	k.probeDestinations()
+	if r.State() != RoutePending {
+		t.Errorf("Route is %s without peers, expected pending", r.State())
+	}
+}
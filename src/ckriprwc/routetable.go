@@ -0,0 +1,239 @@
+package ckriprwc
+
+// The route table module implements the crypto-key routing lookup structure.
+// Each address family is stored in a binary trie keyed on the prefix bits, so
+// a lookup costs at most one step per address bit regardless of how many
+// routes are configured. Tables are never modified in place: every change
+// builds a new table sharing all untouched nodes with the previous one, and
+// the result is published atomically. Readers on the packet path therefore
+// never take a lock.
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+type routeTable struct {
+	v4       *trieNode
+	v6       *trieNode
+	v4Routes []*route // Sorted from most to least specific
+	v6Routes []*route // Sorted from most to least specific
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	route *route
+}
+
+// Returns the bit at position i of the given key, counting from the most
+// significant bit of the first byte.
+func keyBit(key *[16]byte, i int) int {
+	return int(key[i>>3]>>(7-uint(i&7))) & 1
+}
+
+// Returns the trie key for the given address. IPv4 addresses only use the
+// first four bytes.
+func trieKey(addr netip.Addr) (key [16]byte) {
+	if addr.Is4() {
+		a4 := addr.As4()
+		copy(key[:], a4[:])
+	} else {
+		key = addr.As16()
+	}
+	return
+}
+
+// Returns a copy of the trie rooted at n with r stored at the given depth
+// along the path of key. Only the nodes on that path are copied.
+func (n *trieNode) insert(key *[16]byte, bits, depth int, r *route) *trieNode {
+	nn := new(trieNode)
+	if n != nil {
+		*nn = *n
+	}
+	if depth == bits {
+		nn.route = r
+		return nn
+	}
+	b := keyBit(key, depth)
+	nn.child[b] = nn.child[b].insert(key, bits, depth+1, r)
+	return nn
+}
+
+// Returns a copy of the trie rooted at n without the route stored at the
+// given depth along the path of key. Nodes left empty are pruned.
+func (n *trieNode) remove(key *[16]byte, bits, depth int) *trieNode {
+	if n == nil {
+		return nil
+	}
+	nn := *n
+	if depth == bits {
+		nn.route = nil
+	} else {
+		b := keyBit(key, depth)
+		nn.child[b] = nn.child[b].remove(key, bits, depth+1)
+	}
+	if nn.route == nil && nn.child[0] == nil && nn.child[1] == nil {
+		return nil
+	}
+	return &nn
+}
+
+// Returns the route stored for exactly the given prefix, if any.
+func (n *trieNode) get(key *[16]byte, bits int) *route {
+	for depth := 0; n != nil; depth++ {
+		if depth == bits {
+			return n.route
+		}
+		n = n.child[keyBit(key, depth)]
+	}
+	return nil
+}
+
+// Returns the most specific route covering the given key.
+func (n *trieNode) lookup(key *[16]byte, maxBits int) *route {
+	var best *route
+	for depth := 0; n != nil; depth++ {
+		if n.route != nil {
+			best = n.route
+		}
+		if depth == maxBits {
+			break
+		}
+		n = n.child[keyBit(key, depth)]
+	}
+	return best
+}
+
+// Returns a new table containing the given routes. An error is returned if
+// more than one route is given for the same prefix.
+func newRouteTable(routes []*route) (*routeTable, error) {
+	t := &routeTable{}
+	for _, r := range routes {
+		key := trieKey(r.Prefix.Addr())
+		switch {
+		case r.Prefix.Addr().Is4():
+			if t.v4.get(&key, r.Prefix.Bits()) != nil {
+				return nil, fmt.Errorf("remote subnet already exists for %s", r.Prefix)
+			}
+			t.v4 = t.v4.insert(&key, r.Prefix.Bits(), 0, r)
+			t.v4Routes = append(t.v4Routes, r)
+		case r.Prefix.Addr().Is6():
+			if t.v6.get(&key, r.Prefix.Bits()) != nil {
+				return nil, fmt.Errorf("remote subnet already exists for %s", r.Prefix)
+			}
+			t.v6 = t.v6.insert(&key, r.Prefix.Bits(), 0, r)
+			t.v6Routes = append(t.v6Routes, r)
+		}
+	}
+	for _, routes := range [][]*route{t.v4Routes, t.v6Routes} {
+		sort.SliceStable(routes, func(i, j int) bool {
+			return routes[i].Prefix.Bits() > routes[j].Prefix.Bits()
+		})
+	}
+	return t, nil
+}
+
+// Returns the most specific route for the given address, or nil if there is
+// no matching route.
+func (t *routeTable) lookup(addr netip.Addr) *route {
+	key := trieKey(addr)
+	switch {
+	case addr.Is4():
+		return t.v4.lookup(&key, 32)
+	case addr.Is6():
+		return t.v6.lookup(&key, 128)
+	}
+	return nil
+}
+
+// Returns the route configured for exactly the given prefix, or nil if there
+// is no such route.
+func (t *routeTable) get(prefix netip.Prefix) *route {
+	key := trieKey(prefix.Addr())
+	switch {
+	case prefix.Addr().Is4():
+		return t.v4.get(&key, prefix.Bits())
+	case prefix.Addr().Is6():
+		return t.v6.get(&key, prefix.Bits())
+	}
+	return nil
+}
+
+// Returns all of the routes in the table, IPv6 routes first.
+func (t *routeTable) all() []*route {
+	routes := make([]*route, 0, len(t.v6Routes)+len(t.v4Routes))
+	routes = append(routes, t.v6Routes...)
+	return append(routes, t.v4Routes...)
+}
+
+// Returns a new table containing all of the routes of t plus r. An error is
+// returned if a route for the same prefix already exists.
+func (t *routeTable) withRoute(r *route) (*routeTable, error) {
+	if t.get(r.Prefix) != nil {
+		return nil, fmt.Errorf("remote subnet already exists for %s", r.Prefix)
+	}
+	return t.withReplacedRoute(r), nil
+}
+
+// Returns a new table containing all of the routes of t plus r, replacing any
+// existing route for the same prefix.
+func (t *routeTable) withReplacedRoute(r *route) *routeTable {
+	nt := *t
+	key := trieKey(r.Prefix.Addr())
+	switch {
+	case r.Prefix.Addr().Is4():
+		nt.v4 = t.v4.insert(&key, r.Prefix.Bits(), 0, r)
+		nt.v4Routes = insertSorted(t.v4Routes, r)
+	case r.Prefix.Addr().Is6():
+		nt.v6 = t.v6.insert(&key, r.Prefix.Bits(), 0, r)
+		nt.v6Routes = insertSorted(t.v6Routes, r)
+	}
+	return &nt
+}
+
+// Returns a new table containing all of the routes of t except the one for the
+// given prefix, along with the removed route. If there is no route for the
+// prefix then t and nil are returned.
+func (t *routeTable) withoutRoute(prefix netip.Prefix) (*routeTable, *route) {
+	r := t.get(prefix)
+	if r == nil {
+		return t, nil
+	}
+	nt := *t
+	key := trieKey(prefix.Addr())
+	switch {
+	case prefix.Addr().Is4():
+		nt.v4 = t.v4.remove(&key, prefix.Bits(), 0)
+		nt.v4Routes = removeSorted(t.v4Routes, prefix)
+	case prefix.Addr().Is6():
+		nt.v6 = t.v6.remove(&key, prefix.Bits(), 0)
+		nt.v6Routes = removeSorted(t.v6Routes, prefix)
+	}
+	return &nt, r
+}
+
+// Returns a copy of routes with r inserted at its sorted position, replacing
+// any existing route for the same prefix.
+func insertSorted(routes []*route, r *route) []*route {
+	routes = removeSorted(routes, r.Prefix)
+	i := sort.Search(len(routes), func(i int) bool {
+		return routes[i].Prefix.Bits() < r.Prefix.Bits()
+	})
+	nr := make([]*route, 0, len(routes)+1)
+	nr = append(nr, routes[:i]...)
+	nr = append(nr, r)
+	return append(nr, routes[i:]...)
+}
+
+// Returns a copy of routes without the route for the given prefix.
+func removeSorted(routes []*route, prefix netip.Prefix) []*route {
+	for i, r := range routes {
+		if r.Prefix == prefix {
+			nr := make([]*route, 0, len(routes)-1)
+			nr = append(nr, routes[:i]...)
+			return append(nr, routes[i+1:]...)
+		}
+	}
+	return routes
+}
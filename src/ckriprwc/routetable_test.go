@@ -0,0 +1,211 @@
+package ckriprwc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestRouteTableLongestPrefixMatch(t *testing.T) {
+	table := &routeTable{}
+	for _, cidr := range []string{
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"::/0",
+		"fd00::/8",
+		"fd00:1::/32",
+	} {
+		var err error
+		if table, err = table.withRoute(&route{Prefix: netip.MustParsePrefix(cidr)}); err != nil {
+			t.Fatalf("Failed to add %s: %s", cidr, err)
+		}
+	}
+	for addr, want := range map[string]string{
+		"192.168.1.1": "0.0.0.0/0",
+		"10.2.3.4":    "10.0.0.0/8",
+		"10.1.3.4":    "10.1.0.0/16",
+		"10.1.2.3":    "10.1.2.0/24",
+		"2001:db8::1": "::/0",
+		"fd00:2::1":   "fd00::/8",
+		"fd00:1::1":   "fd00:1::/32",
+	} {
+		r := table.lookup(netip.MustParseAddr(addr))
+		if r == nil || r.Prefix.String() != want {
+			t.Errorf("Lookup of %s returned %v, expected %s", addr, r, want)
+		}
+	}
+
+	old := table
+	table, removed := table.withoutRoute(netip.MustParsePrefix("10.1.0.0/16"))
+	if removed == nil {
+		t.Fatal("Expected 10.1.0.0/16 to be removed")
+	}
+	if r := table.lookup(netip.MustParseAddr("10.1.3.4")); r == nil || r.Prefix.String() != "10.0.0.0/8" {
+		t.Errorf("Lookup after removal returned %v, expected 10.0.0.0/8", r)
+	}
+	if r := old.lookup(netip.MustParseAddr("10.1.3.4")); r == nil || r.Prefix.String() != "10.1.0.0/16" {
+		t.Errorf("Removal modified the previous table, lookup returned %v", r)
+	}
+	if len(table.v4Routes) != 3 || len(old.v4Routes) != 4 {
+		t.Errorf("Unexpected route list lengths %d and %d", len(table.v4Routes), len(old.v4Routes))
+	}
+	if _, err := table.withRoute(&route{Prefix: netip.MustParsePrefix("10.0.0.0/8")}); err == nil {
+		t.Error("Expected duplicate prefix to be rejected")
+	}
+}
+
+func randomRoutes(size int, v6 bool) ([]*route, []netip.Addr) {
+	rng := rand.New(rand.NewSource(1))
+	routes := make([]*route, 0, size)
+	addrs := make([]netip.Addr, 0, size)
+	seen := make(map[netip.Prefix]bool, size)
+	for len(routes) < size {
+		var addr netip.Addr
+		var bits int
+		if v6 {
+			var a16 [16]byte
+			rng.Read(a16[:])
+			addr, bits = netip.AddrFrom16(a16), 16+rng.Intn(113)
+		} else {
+			var a4 [4]byte
+			binary.BigEndian.PutUint32(a4[:], rng.Uint32())
+			addr, bits = netip.AddrFrom4(a4), 8+rng.Intn(25)
+		}
+		if prefix := netip.PrefixFrom(addr, bits).Masked(); !seen[prefix] {
+			seen[prefix] = true
+			routes = append(routes, &route{Prefix: prefix})
+			addrs = append(addrs, addr)
+		}
+	}
+	return routes, addrs
+}
+
+func benchmarkTable(b *testing.B, size int, v6 bool) {
+	routes, addrs := randomRoutes(size, v6)
+	table, err := newRouteTable(routes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if table.lookup(addrs[i%len(addrs)]) == nil {
+			b.Fatal("Lookup failed")
+		}
+	}
+}
+
+func BenchmarkRouteTableLookupIPv4(b *testing.B) {
+	for _, size := range []int{16, 256, 4096, 65536} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			benchmarkTable(b, size, false)
+		})
+	}
+}
+
+func BenchmarkRouteTableLookupIPv6(b *testing.B) {
+	for _, size := range []int{16, 256, 4096, 65536} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			benchmarkTable(b, size, true)
+		})
+	}
+}
+
+// Measures the sorted linear scan that the trie replaced, for comparison.
+func BenchmarkRouteTableLinearIPv4(b *testing.B) {
+	for _, size := range []int{16, 256, 4096} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			routes, addrs := randomRoutes(size, false)
+			table, err := newRouteTable(routes)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				addr := addrs[i%len(addrs)]
+				found := false
+				for _, r := range table.v4Routes {
+					if r.Prefix.Contains(addr) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					b.Fatal("Lookup failed")
+				}
+			}
+		})
+	}
+}
+
+func TestRouteSelectGateway(t *testing.T) {
+	gateways := make([]*gateway, 4)
+	for i := range gateways {
+		gateways[i] = &gateway{
+			key:      make([]byte, 32),
+			priority: uint8(i / 3),
+			reach:    &keyState{state: int32(RouteReachable)},
+		}
+		gateways[i].key[0] = byte(i)
+	}
+	r := &route{gateways: gateways}
+	used := make(map[*gateway]bool)
+	for flow := uint64(0); flow < 64; flow++ {
+		g := r.selectGateway(flow)
+		if g != r.selectGateway(flow) {
+			t.Fatal("The same flow was sent to different gateways")
+		}
+		used[g] = true
+	}
+	if len(used) != 3 || used[gateways[3]] {
+		t.Errorf("Expected flows to be balanced across the three preferred gateways, got %d", len(used))
+	}
+	for _, g := range gateways[:3] {
+		g.reach.state = int32(RouteUnreachable)
+	}
+	if g := r.selectGateway(0); g != gateways[3] {
+		t.Error("Expected failover to the least preferred gateway")
+	}
+}
+
+func TestGatewayPriorityOrder(t *testing.T) {
+	// Given out of order, as gateways are sorted by priority when added
+	priorities := []uint8{2, 0, 1}
+	gateways := make([]*gateway, len(priorities))
+	for i, priority := range priorities {
+		gateways[i] = &gateway{
+			key:      make([]byte, 32),
+			priority: priority,
+			reach:    &keyState{state: int32(RouteReachable)},
+		}
+		gateways[i].key[0] = priority
+	}
+	sortGateways(gateways)
+	r := &route{gateways: gateways}
+	for i, g := range r.gateways {
+		if g.priority != uint8(i) {
+			t.Fatalf("Gateway %d has priority %d, expected them to be sorted", i, g.priority)
+		}
+	}
+	expect := func(priority uint8, why string) {
+		t.Helper()
+		if g := r.selectGateway(0); g.priority != priority {
+			t.Errorf("Selected the gateway with priority %d, expected %d %s", g.priority, priority, why)
+		}
+	}
+	expect(0, "while all are reachable")
+	gateways[0].reach.state = int32(RouteUnreachable)
+	expect(1, "after the first failed")
+	gateways[0].reach.state = int32(RoutePending)
+	expect(1, "over a pending gateway")
+	gateways[1].reach.state = int32(RouteUnreachable)
+	gateways[2].reach.state = int32(RouteUnreachable)
+	expect(0, "as the only pending gateway")
+	gateways[0].reach.state = int32(RouteUnreachable)
+	expect(0, "when none are reachable")
+	gateways[2].reach.state = int32(RouteReachable)
+	expect(2, "as the only reachable gateway")
+}
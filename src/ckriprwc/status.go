@@ -0,0 +1,92 @@
+package ckriprwc
+
+// The status module reports the live state of the key store, as opposed to
+// the configuration it was started with, so that it can be inspected while the
+// node is running.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/RiV-chain/RiV-mesh/src/core"
+)
+
+// KeyStatus describes a key in the key store cache.
+type KeyStatus struct {
+	PublicKey ed25519.PublicKey
+	Address   core.Address
+	Subnet    core.Subnet
+	Expires   time.Duration // How long until the key is dropped from the cache unless it is used
+}
+
+// LookupStatus describes a mesh destination whose key is being looked up, or
+// which is negatively cached because the lookup failed.
+type LookupStatus struct {
+	Destination net.IP        // The mesh address, or the prefix of the mesh subnet
+	Subnet      bool          // Whether Destination is a mesh subnet
+	Lookups     int           // The number of lookups sent without an answer
+	Queued      int           // The number of packets waiting for the key
+	Expires     time.Duration // How long until the destination is forgotten
+	Unreachable time.Duration // How long the destination stays negatively cached, or 0
+}
+
+// Returns the keys in the key store cache, ordered by key.
+func (k *keyStore) cachedKeys() []KeyStatus {
+	now := time.Now()
+	k.mutex.Lock()
+	keys := make([]KeyStatus, 0, len(k.keyToInfo))
+	for _, info := range k.keyToInfo {
+		keys = append(keys, KeyStatus{
+			PublicKey: append(ed25519.PublicKey(nil), info.key[:]...),
+			Address:   info.address,
+			Subnet:    info.subnet,
+			Expires:   remaining(now, info.expires),
+		})
+	}
+	k.mutex.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i].PublicKey, keys[j].PublicKey) < 0
+	})
+	return keys
+}
+
+// Returns the destinations whose keys are being looked up, ordered by address.
+func (k *keyStore) pendingLookups() []LookupStatus {
+	now := time.Now()
+	status := func(dest []byte, subnet bool, buf *buffer) LookupStatus {
+		return LookupStatus{
+			Destination: net.IP(append([]byte(nil), dest...)),
+			Subnet:      subnet,
+			Lookups:     buf.lookups,
+			Queued:      len(buf.packets),
+			Expires:     remaining(now, buf.expires),
+			Unreachable: remaining(now, buf.unreachable),
+		}
+	}
+	k.mutex.Lock()
+	lookups := make([]LookupStatus, 0, len(k.addrBuffer)+len(k.subnetBuffer))
+	for addr, buf := range k.addrBuffer {
+		lookups = append(lookups, status(addr[:], false, buf))
+	}
+	for subnet, buf := range k.subnetBuffer {
+		var addr core.Address
+		copy(addr[:], subnet[:])
+		lookups = append(lookups, status(addr[:], true, buf))
+	}
+	k.mutex.Unlock()
+	sort.Slice(lookups, func(i, j int) bool {
+		return bytes.Compare(lookups[i].Destination, lookups[j].Destination) < 0
+	})
+	return lookups
+}
+
+// Returns the time left from now until the given time, or 0 if it has passed.
+func remaining(now, t time.Time) time.Duration {
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package ckriprwc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RiV-chain/RiV-mesh/src/core"
+)
+
+func TestPendingLookups(t *testing.T) {
+	k := &keyStore{
+		addrBuffer:   make(map[core.Address]*buffer),
+		subnetBuffer: make(map[core.Subnet]*buffer),
+	}
+	var addr core.Address
+	addr[0], addr[15] = 0x21, 1
+	var subnet core.Subnet
+	subnet[0] = 0x31
+	now := time.Now()
+	k.addrBuffer[addr] = &buffer{packets: [][]byte{{1}, {2}}, lookups: 2, expires: now.Add(time.Minute)}
+	k.subnetBuffer[subnet] = &buffer{expires: now.Add(time.Minute), unreachable: now.Add(30 * time.Second)}
+
+	lookups := k.pendingLookups()
+	if len(lookups) != 2 {
+		t.Fatalf("Got %d pending lookups, expected 2", len(lookups))
+	}
+	if a := lookups[0]; a.Subnet || a.Queued != 2 || a.Lookups != 2 || a.Unreachable != 0 || a.Expires <= 0 {
+		t.Errorf("Unexpected status %+v for the address", a)
+	}
+	if s := lookups[1]; !s.Subnet || s.Destination.String() != "3100::" || s.Unreachable <= 0 {
+		t.Errorf("Unexpected status %+v for the subnet", s)
+	}
+}
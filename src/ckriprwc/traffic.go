@@ -0,0 +1,206 @@
+package ckriprwc
+
+// The traffic module counts the packets and bytes tunnelled through each
+// crypto-key route and exchanged with each remote key, in both directions, so
+// that traffic can be accounted for. The counters only ever go up, so that
+// they can be exported as monitoring counters, and resetting them only moves
+// the baseline that the values reported by Traffic are counted from. The
+// counters are kept by prefix and by key rather than in the routes and key
+// infos themselves, so that they carry on counting when a route is replaced or
+// a key times out of the key store. The counters of prefixes which are no
+// longer routed and keys which are no longer used are pruned periodically, so
+// that they don't build up.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+)
+
+// The counters for a route or key, all accessed atomically.
+type trafficCounters struct {
+	txPackets uint64
+	txBytes   uint64
+	rxPackets uint64
+	rxBytes   uint64
+	base      [4]uint64 // The values of the counters when they were last reset
+}
+
+// Counts a packet sent to the mesh.
+func (t *trafficCounters) countTx(n int) {
+	atomic.AddUint64(&t.txPackets, 1)
+	atomic.AddUint64(&t.txBytes, uint64(n))
+}
+
+// Counts a packet received from the mesh.
+func (t *trafficCounters) countRx(n int) {
+	atomic.AddUint64(&t.rxPackets, 1)
+	atomic.AddUint64(&t.rxBytes, uint64(n))
+}
+
+// Returns the values of the counters since they were last reset, resetting
+// them at the same time if reset is set so that no packets go uncounted.
+func (t *trafficCounters) snapshot(reset bool) TrafficCounters {
+	load := func(addr *uint64, base *uint64) uint64 {
+		current := atomic.LoadUint64(addr)
+		if reset {
+			return current - atomic.SwapUint64(base, current)
+		}
+		return current - atomic.LoadUint64(base)
+	}
+	return TrafficCounters{
+		TxPackets: load(&t.txPackets, &t.base[0]),
+		TxBytes:   load(&t.txBytes, &t.base[1]),
+		RxPackets: load(&t.rxPackets, &t.base[2]),
+		RxBytes:   load(&t.rxBytes, &t.base[3]),
+	}
+}
+
+// Returns the values of the counters since they were created, which are never
+// reset.
+func (t *trafficCounters) totals() TrafficCounters {
+	return TrafficCounters{
+		TxPackets: atomic.LoadUint64(&t.txPackets),
+		TxBytes:   atomic.LoadUint64(&t.txBytes),
+		RxPackets: atomic.LoadUint64(&t.rxPackets),
+		RxBytes:   atomic.LoadUint64(&t.rxBytes),
+	}
+}
+
+// TrafficCounters holds the number of packets and bytes sent to and received
+// from the mesh.
+type TrafficCounters struct {
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+}
+
+// RouteTraffic holds the traffic counters for a routed prefix.
+type RouteTraffic struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Active bool         `json:"active"` // Whether there is currently a route for the prefix
+	TrafficCounters
+}
+
+// KeyTraffic holds the traffic counters for a remote key.
+type KeyTraffic struct {
+	PublicKey ed25519.PublicKey `json:"key"`
+	TrafficCounters
+}
+
+// Traffic is a snapshot of the traffic counters.
+type Traffic struct {
+	Routes []RouteTraffic `json:"routes"`
+	Keys   []KeyTraffic   `json:"keys"`
+}
+
+// Returns the traffic counters for the given prefix.
+func (c *cryptokey) routeTraffic(prefix netip.Prefix) *trafficCounters {
+	if t, ok := c.traffic.Load(prefix); ok {
+		return t.(*trafficCounters)
+	}
+	t, _ := c.traffic.LoadOrStore(prefix, new(trafficCounters))
+	return t.(*trafficCounters)
+}
+
+// Returns the traffic counters for the given key.
+func (k *keyStore) keyTraffic(key keyArray) *trafficCounters {
+	if t, ok := k.traffic.Load(key); ok {
+		return t.(*trafficCounters)
+	}
+	t, _ := k.traffic.LoadOrStore(key, new(trafficCounters))
+	return t.(*trafficCounters)
+}
+
+// Returns a snapshot of the traffic counters for all of the prefixes and keys
+// that have been counted. If reset is set then the counters are reset, and
+// those of prefixes without a route and keys which are neither in the key
+// store nor the destination of a route are forgotten.
+func (k *keyStore) trafficSnapshot(reset bool) Traffic {
+	return k.collectTraffic(func(t *trafficCounters) TrafficCounters {
+		return t.snapshot(reset)
+	}, reset)
+}
+
+// Returns the totals of the traffic counters for all of the prefixes and keys
+// that have been counted, which are never reset.
+func (k *keyStore) trafficTotals() Traffic {
+	return k.collectTraffic((*trafficCounters).totals, false)
+}
+
+// Reads the traffic counters for all of the prefixes and keys with the given
+// function. If forget is set then those of prefixes without a route and keys
+// which are neither in the key store nor the destination of a route are
+// forgotten.
+func (k *keyStore) collectTraffic(read func(*trafficCounters) TrafficCounters, forget bool) Traffic {
+	var traffic Traffic
+	table := k.ckr.routes()
+	k.ckr.traffic.Range(func(key, value interface{}) bool {
+		prefix := key.(netip.Prefix)
+		active := table.get(prefix) != nil
+		traffic.Routes = append(traffic.Routes, RouteTraffic{
+			Prefix:          prefix,
+			Active:          active,
+			TrafficCounters: read(value.(*trafficCounters)),
+		})
+		if forget && !active {
+			k.ckr.traffic.Delete(prefix)
+		}
+		return true
+	})
+	states := k.ckr.keyStates()
+	k.mutex.Lock()
+	k.traffic.Range(func(key, value interface{}) bool {
+		kArray := key.(keyArray)
+		traffic.Keys = append(traffic.Keys, KeyTraffic{
+			PublicKey:       append(ed25519.PublicKey(nil), kArray[:]...),
+			TrafficCounters: read(value.(*trafficCounters)),
+		})
+		if _, ok := k.keyToInfo[kArray]; forget && !ok && states[kArray] == nil {
+			k.traffic.Delete(kArray)
+		}
+		return true
+	})
+	k.mutex.Unlock()
+	sort.Slice(traffic.Routes, func(i, j int) bool {
+		a, b := traffic.Routes[i].Prefix, traffic.Routes[j].Prefix
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+	sort.Slice(traffic.Keys, func(i, j int) bool {
+		return bytes.Compare(traffic.Keys[i].PublicKey, traffic.Keys[j].PublicKey) < 0
+	})
+	return traffic
+}
+
+// Forgets the traffic counters of prefixes which are neither routed nor in the
+// table from the route controller, and of keys which are neither in the key
+// store nor the destination of a route.
+func (k *keyStore) pruneTraffic() {
+	c := k.ckr
+	c.mutex.Lock()
+	table := c.routes()
+	c.traffic.Range(func(key, _ interface{}) bool {
+		prefix := key.(netip.Prefix)
+		if table.get(prefix) == nil && (c.controlled == nil || c.controlled.routes[prefix] == nil) {
+			c.traffic.Delete(prefix)
+		}
+		return true
+	})
+	c.mutex.Unlock()
+	states := c.keyStates()
+	k.mutex.Lock()
+	k.traffic.Range(func(key, _ interface{}) bool {
+		kArray := key.(keyArray)
+		if _, ok := k.keyToInfo[kArray]; !ok && states[kArray] == nil {
+			k.traffic.Delete(kArray)
+		}
+		return true
+	})
+	k.mutex.Unlock()
+}
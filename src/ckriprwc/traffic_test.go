@@ -0,0 +1,95 @@
+package ckriprwc
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+func TestTrafficCounters(t *testing.T) {
+	k := &keyStore{}
+	var key keyArray
+	key[0] = 1
+	k.keyTraffic(key).countTx(100)
+	k.keyTraffic(key).countTx(50)
+	k.keyTraffic(key).countRx(20)
+	counters := k.keyTraffic(key)
+	if got := counters.snapshot(true); got != (TrafficCounters{TxPackets: 2, TxBytes: 150, RxPackets: 1, RxBytes: 20}) {
+		t.Fatalf("Unexpected counters %+v", got)
+	}
+	if got := counters.snapshot(false); got != (TrafficCounters{}) {
+		t.Errorf("Counters %+v weren't reset", got)
+	}
+	counters.countTx(10)
+	if got := counters.snapshot(false); got != (TrafficCounters{TxPackets: 1, TxBytes: 10}) {
+		t.Errorf("Unexpected counters %+v after reset", got)
+	}
+	// The totals aren't reset
+	if got := counters.totals(); got != (TrafficCounters{TxPackets: 3, TxBytes: 160, RxPackets: 1, RxBytes: 20}) {
+		t.Errorf("Unexpected totals %+v", got)
+	}
+}
+
+func TestTrafficSnapshot(t *testing.T) {
+	gw, hexKey := testKey(t)
+	ckr := newTestCryptokey(t, &config.TunnelRoutingConfig{
+		Enable:            true,
+		IPv4RemoteSubnets: map[string]string{"10.0.0.0/8": hexKey, "10.1.0.0/16": hexKey},
+	})
+	k := &keyStore{core: ckr.core, ckr: ckr, keyToInfo: make(map[keyArray]*keyInfo)}
+	var gwKey, cached, gone keyArray
+	copy(gwKey[:], gw)
+	cached[0], gone[0] = 1, 2
+	k.keyToInfo[cached] = &keyInfo{key: cached}
+	for _, key := range []keyArray{gwKey, cached, gone} {
+		k.keyTraffic(key).countTx(10)
+	}
+	routed := netip.MustParsePrefix("10.0.0.0/8")
+	removed := netip.MustParsePrefix("10.1.0.0/16")
+	ckr.routes().get(routed).traffic.countRx(100)
+	ckr.routes().get(removed).traffic.countTx(200)
+	if err := ckr.removeRoute(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	traffic := k.trafficSnapshot(false)
+	if len(traffic.Routes) != 2 || len(traffic.Keys) != 3 {
+		t.Fatalf("Got counters for %d routes and %d keys, expected 2 and 3", len(traffic.Routes), len(traffic.Keys))
+	}
+	if r := traffic.Routes[0]; r.Prefix != routed || !r.Active || r.RxBytes != 100 {
+		t.Errorf("Unexpected counters %+v for %s", r, routed)
+	}
+	if r := traffic.Routes[1]; r.Prefix != removed || r.Active || r.TxBytes != 200 {
+		t.Errorf("Unexpected counters %+v for %s", r, removed)
+	}
+
+	// Resetting returns the counts once, then forgets what is no longer used
+	if traffic := k.trafficSnapshot(true); len(traffic.Routes) != 2 || traffic.Routes[1].TxBytes != 200 {
+		t.Fatal("Expected the counters to be returned when resetting them")
+	}
+	traffic = k.trafficSnapshot(false)
+	if len(traffic.Routes) != 1 || traffic.Routes[0].RxBytes != 0 {
+		t.Errorf("Unexpected route counters %+v after resetting", traffic.Routes)
+	}
+	if len(traffic.Keys) != 2 {
+		t.Errorf("Unexpected key counters %+v after resetting", traffic.Keys)
+	}
+
+	// Counters which are no longer used are pruned without being reset
+	for _, key := range []keyArray{gwKey, cached, gone} {
+		k.keyTraffic(key).countTx(10)
+	}
+	ckr.routeTraffic(removed).countTx(10)
+	k.pruneTraffic()
+	traffic = k.trafficSnapshot(false)
+	if len(traffic.Routes) != 1 || len(traffic.Keys) != 2 {
+		t.Errorf("Got counters for %d routes and %d keys after pruning, expected 1 and 2", len(traffic.Routes), len(traffic.Keys))
+	}
+	for _, kt := range traffic.Keys {
+		if bytes.Equal(kt.PublicKey, gone[:]) {
+			t.Error("Counters of an unused key weren't pruned")
+		}
+	}
+}
@@ -7,7 +7,65 @@ type NodeConfig struct {
 // TunnelRoutingConfig contains the crypto-key routing tables for tunneling regular
 // IPv4 or IPv6 subnets across the RiV-mesh network.
 type TunnelRoutingConfig struct {
-	Enable            bool              `comment:"Enable or disable tunnel routing."`
-	IPv6RemoteSubnets map[string]string `comment:"IPv6 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"aaaa:bbbb:cccc::/e\": \"boxpubkey\", ... }"`
-	IPv4RemoteSubnets map[string]string `comment:"IPv4 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"a.b.c.d/e\": \"boxpubkey\", ... }"`
+	Enable              bool                       `comment:"Enable or disable tunnel routing."`
+	IPv6RemoteSubnets   map[string]string          `comment:"IPv6 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"aaaa:bbbb:cccc::/e\": \"boxpubkey\", ... }"`
+	IPv4RemoteSubnets   map[string]string          `comment:"IPv4 subnets belonging to remote nodes, mapped to the node's public\nkey, e.g. { \"a.b.c.d/e\": \"boxpubkey\", ... }"`
+	IPv6RemoteGateways  map[string][]RemoteGateway `comment:"IPv6 subnets reachable through several remote nodes, mapped to a list\nof gateways, e.g. { \"::/0\": [ { PublicKey: \"boxpubkey\", Priority: 0 }, ... ] }.\nTraffic is sent to the most preferred gateway which is reachable."`
+	IPv4RemoteGateways  map[string][]RemoteGateway `comment:"IPv4 subnets reachable through several remote nodes, mapped to a list\nof gateways, e.g. { \"0.0.0.0/0\": [ { PublicKey: \"boxpubkey\", Priority: 0 }, ... ] }.\nTraffic is sent to the most preferred gateway which is reachable."`
+	IPv6LocalSubnets    []string                   `comment:"IPv6 subnets belonging to this node which may be used as source\naddresses of tunnelled traffic, e.g. [ \"aaaa:bbbb:cccc::/e\", ... ]"`
+	IPv4LocalSubnets    []string                   `comment:"IPv4 subnets belonging to this node which may be used as source\naddresses of tunnelled traffic, e.g. [ \"a.b.c.d/e\", ... ]"`
+	StrictSource        bool                       `comment:"Drop packets from the TUN adapter whose source address is not this\nnode's address, subnet or one of the local subnets above."`
+	AdvertiseRoutes     bool                       `comment:"Advertise the local subnets above to nodes which trust this node as\nan announcer, so that they can route to them without configuration."`
+	TrustedAnnouncers   []string                   `comment:"Public keys of remote nodes whose advertised subnets are installed as\nroutes automatically. Configured remote subnets always take precedence."`
+	ControllerKey       string                     `comment:"Public key of the administrator whose signed routing tables are\ntrusted. Tables are applied when their version increases."`
+	ControllerNodes     []string                   `comment:"Public keys of the nodes to fetch signed routing tables from."`
+	ControllerCache     string                     `comment:"Path of a file to keep the last signed routing table in, so that\nit is applied straight away when starting without connectivity."`
+	RouteController     *RouteControllerConfig     `comment:"Serve signed routing tables to other nodes as a route controller."`
+	ClampMSS            bool                       `comment:"Clamp the MSS of TCP connections through the TUN adapter to fit its\nMTU, for paths where path MTU discovery doesn't work."`
+	RouteMSS            map[string]uint16          `comment:"The MSS to clamp TCP connections to for individual remote subnets,\ninstead of deriving it from the MTU, e.g. { \"a.b.c.d/e\": 1200, ... }"`
+	PendingQueuePackets int                        `comment:"Maximum number of packets queued for each destination while its key\nis being looked up. Defaults to 32."`
+	PendingQueueBytes   int                        `comment:"Maximum number of bytes queued for each destination while its key\nis being looked up. Defaults to 65536."`
+	PendingQueueMemory  int                        `comment:"Maximum number of bytes queued across all destinations while their\nkeys are being looked up. Defaults to 4194304."`
+	DropLogSample       int                        `comment:"Log why one in every this many dropped packets was dropped, along\nwith its addresses and ports, at debug level. 0 disables the log."`
+	RouteTable          int                        `comment:"ID of the routing table to install the remote subnets into, instead\nof the main table. Linux only."`
+	RouteMetric         int                        `comment:"Metric of the routes for the remote subnets. Linux only."`
+	RouteProtocol       int                        `comment:"Protocol ID of the routes for the remote subnets, which is how they\nare told apart from other routes. Defaults to 82. Linux only."`
+	RoutingRules        []RoutingRule              `comment:"Policy routing rules which send traffic to the routing table above,\nwhich must be set, e.g. [ { Mark: 51820 }, { Source: \"a.b.c.d/e\" } ].\nLinux only."`
+	ExitClient          bool                       `comment:"Send all traffic through the tunnel while there is a remote subnet\nfor 0.0.0.0/0 or ::/0, keeping peering traffic on the original\ngateway. Linux only."`
+	ExitServer          bool                       `comment:"Act as an internet gateway for the remote subnets, by enabling\nforwarding and masquerading their traffic with nftables. Linux only."`
+	KillSwitch          bool                       `comment:"Block all traffic outside the tunnel, except to peers, loopback and\nthe local networks, while a remote subnet for 0.0.0.0/0 or ::/0 is\nconfigured, so that nothing leaks when the mesh is down. Linux only."`
+	KillSwitchAllow     []string                   `comment:"Further subnets which may be reached outside the tunnel while the\nkill switch is on, e.g. [ \"a.b.c.d/e\" ]"`
+}
+
+// RemoteGateway is one of the remote nodes that a routed subnet can be
+// tunnelled to.
+type RemoteGateway struct {
+	PublicKey string `comment:"The public key of the remote node."`
+	Priority  uint8  `comment:"Priority of this gateway, lower values are more preferred."`
+}
+
+// RoutingRule selects traffic to be routed with the remote subnets, by fwmark
+// or by source prefix.
+type RoutingRule struct {
+	Mark     uint32 `comment:"The fwmark to match, or 0 to match any."`
+	Mask     uint32 `comment:"The mask applied to the fwmark, or 0 to match it exactly."`
+	Source   string `comment:"The source prefix to match, or empty to match any."`
+	Priority int    `comment:"The priority of the rule, or 0 for the default of 5282."`
+}
+
+// RouteControllerConfig contains the routing tables which a route controller
+// signs and serves to other nodes.
+type RouteControllerConfig struct {
+	PrivateKey string                     `comment:"The administrator's private key, which the tables are signed with."`
+	Version    uint64                     `comment:"Version of the tables. Nodes only apply tables with a higher version\nthan the one they already have, so increase this after every change."`
+	Table      ControllerTable            `comment:"The table served to nodes which don't have a table of their own."`
+	NodeTables map[string]ControllerTable `comment:"Tables for individual nodes, mapped to the node's public key."`
+}
+
+// ControllerTable is a routing table distributed by a route controller.
+type ControllerTable struct {
+	IPv6RemoteSubnets  map[string]string
+	IPv4RemoteSubnets  map[string]string
+	IPv6RemoteGateways map[string][]RemoteGateway
+	IPv4RemoteGateways map[string][]RemoteGateway
 }
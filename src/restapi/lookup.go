@@ -0,0 +1,94 @@
+package restapi
+
+// The lookup module explains how the VPN layer handles packets to and from an
+// address, for debugging routes that only work in one direction.
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/RiV-chain/RiV-mesh/src/restapi"
+)
+
+// @Summary		Explain how packets to and from an address are handled. The optional query parameter key checks whether packets from the address are accepted from that key. The output contains following fields: Address, Mesh address, Mesh subnet, Outbound, Inbound
+// @Produce		json
+// @Success		200		{string}	string		"ok"
+// @Failure		400		{error}		error		"Bad request"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Router		/tunnelrouting/lookup/{address} [get]
+func (a *RestServer) getApiTunnelRoutingLookup(w http.ResponseWriter, r *http.Request) {
+	addr, err := netip.ParseAddr(strings.TrimPrefix(r.URL.Path, "/api/tunnelrouting/lookup/"))
+	if err != nil {
+		http.Error(w, "Address is invalid", http.StatusBadRequest)
+		return
+	}
+	var from ed25519.PublicKey
+	if key := r.URL.Query().Get("key"); key != "" {
+		if from, err = hex.DecodeString(key); err != nil || len(from) != ed25519.PublicKeySize {
+			http.Error(w, "Public key is invalid", http.StatusBadRequest)
+			return
+		}
+	}
+	d := a.rwc.Diagnose(addr.Unmap(), from)
+	keyString := func(key ed25519.PublicKey) any {
+		if key == nil {
+			return nil
+		}
+		return hex.EncodeToString(key)
+	}
+	prefixString := func(prefix netip.Prefix) any {
+		if !prefix.IsValid() {
+			return nil
+		}
+		return prefix.String()
+	}
+	errString := func(err error) any {
+		if err == nil {
+			return nil
+		}
+		return err.Error()
+	}
+	outbound := map[string]any{
+		"prefix":      prefixString(d.Outbound.Prefix),
+		"origin":      nil,
+		"key":         keyString(d.Outbound.Key),
+		"address":     nil,
+		"cached":      d.Outbound.Cached,
+		"lookup":      d.Outbound.Lookup,
+		"unreachable": d.Outbound.Unreachable,
+		"mtu":         d.Outbound.MTU,
+		"error":       errString(d.Outbound.Err),
+	}
+	if d.Outbound.Prefix.IsValid() {
+		outbound["origin"] = d.Outbound.Origin
+	}
+	if d.Outbound.Key != nil {
+		addr := a.server.Core.AddrForKey(d.Outbound.Key)
+		outbound["address"] = net.IP(addr[:]).String()
+	}
+	keys := make([]string, 0, len(d.Inbound.Keys))
+	for _, key := range d.Inbound.Keys {
+		keys = append(keys, hex.EncodeToString(key))
+	}
+	inbound := map[string]any{
+		"prefix": prefixString(d.Inbound.Prefix),
+		"keys":   keys,
+		"from":   keyString(d.Inbound.From),
+		"mtu":    d.Inbound.MTU,
+		"error":  errString(d.Inbound.Err),
+	}
+	if d.Inbound.From != nil {
+		inbound["accepted"] = d.Inbound.Err == nil
+	}
+	restapi.WriteJson(w, r, map[string]any{
+		"address":      d.Address.String(),
+		"mesh_address": d.MeshAddress,
+		"mesh_subnet":  d.MeshSubnet,
+		"outbound":     outbound,
+		"inbound":      inbound,
+	})
+}
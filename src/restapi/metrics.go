@@ -0,0 +1,99 @@
+package restapi
+
+// The metrics module exposes the counters of the VPN layer in the Prometheus
+// text exposition format, so that they can be scraped along with everything
+// else.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/RiV-chain/RiVPN/src/ckriprwc"
+)
+
+// Writes metrics in the Prometheus text format. The HELP and TYPE lines are
+// written before the first sample of each metric.
+type metricsWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func (m *metricsWriter) sample(name, kind, help string, labels map[string]string, value any) {
+	if !m.seen[name] {
+		m.seen[name] = true
+		fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	if len(labels) == 0 {
+		fmt.Fprintf(m.w, "%s %v\n", name, value)
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, label := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, labels[label]))
+	}
+	fmt.Fprintf(m.w, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+}
+
+// @Summary		Show VPN metrics in the Prometheus text format.
+// @Produce		plain
+// @Success		200		{string}	string		"ok"
+// @Failure		400		{error}		error		"Method not allowed"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Router		/metrics [get]
+func (a *RestServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := &metricsWriter{w: w, seen: make(map[string]bool)}
+
+	stats := a.rwc.Stats()
+	m.sample("rivpn_key_cache_entries", "gauge", "Number of keys in the key store cache.", nil, stats.CachedKeys)
+	m.sample("rivpn_pending_lookups", "gauge", "Number of key lookups in flight.", nil, stats.PendingLookups)
+	m.sample("rivpn_queued_packets", "gauge", "Number of packets queued while their keys are looked up.", nil, stats.QueuedPackets)
+	m.sample("rivpn_queued_bytes", "gauge", "Number of bytes queued while their keys are looked up.", nil, stats.QueuedBytes)
+	reasons := make([]ckriprwc.DropReason, 0, len(stats.Drops))
+	for reason := range stats.Drops {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i] < reasons[j] })
+	for _, reason := range reasons {
+		m.sample("rivpn_dropped_packets_total", "counter", "Number of packets dropped, by reason.",
+			map[string]string{"reason": reason.String()}, stats.Drops[reason])
+	}
+
+	m.sample("rivpn_routes", "gauge", "Number of active crypto-key routes.", map[string]string{"family": "ipv4"}, len(a.rwc.V4Routes()))
+	m.sample("rivpn_routes", "gauge", "Number of active crypto-key routes.", map[string]string{"family": "ipv6"}, len(a.rwc.V6Routes()))
+	// The totals are used as resetting the traffic counters through the API
+	// would look like a restart to the monitoring system
+	traffic := a.rwc.TrafficTotals()
+	for _, route := range traffic.Routes {
+		labels := map[string]string{"prefix": route.Prefix.String()}
+		m.sample("rivpn_route_tx_packets_total", "counter", "Number of packets sent through a crypto-key route.", labels, route.TxPackets)
+	}
+	for _, route := range traffic.Routes {
+		labels := map[string]string{"prefix": route.Prefix.String()}
+		m.sample("rivpn_route_tx_bytes_total", "counter", "Number of bytes sent through a crypto-key route.", labels, route.TxBytes)
+	}
+	for _, route := range traffic.Routes {
+		labels := map[string]string{"prefix": route.Prefix.String()}
+		m.sample("rivpn_route_rx_packets_total", "counter", "Number of packets received through a crypto-key route.", labels, route.RxPackets)
+	}
+	for _, route := range traffic.Routes {
+		labels := map[string]string{"prefix": route.Prefix.String()}
+		m.sample("rivpn_route_rx_bytes_total", "counter", "Number of bytes received through a crypto-key route.", labels, route.RxBytes)
+	}
+
+	if a.tun != nil {
+		read, write := a.tun.Errors()
+		m.sample("rivpn_tun_read_errors_total", "counter", "Number of failed reads from the TUN adapter.", nil, read)
+		m.sample("rivpn_tun_write_errors_total", "counter", "Number of failed writes to the TUN adapter.", nil, write)
+	}
+	m.sample("rivpn_mtu", "gauge", "Current MTU of the VPN layer.", nil, a.rwc.MTU())
+	m.sample("rivpn_peers", "gauge", "Number of connected mesh peers.", nil, len(a.server.Core.GetPeers()))
+}
@@ -1,30 +1,62 @@
 package restapi
 
 import (
+	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	c "github.com/RiV-chain/RiV-mesh/src/config"
 	d "github.com/RiV-chain/RiV-mesh/src/defaults"
 	"github.com/RiV-chain/RiV-mesh/src/restapi"
+	"github.com/RiV-chain/RiVPN/src/ckriprwc"
 	"github.com/RiV-chain/RiVPN/src/config"
+	"github.com/RiV-chain/RiVPN/src/tun"
 )
 
 type RestServer struct {
 	server *restapi.RestServer
 	config *c.NodeConfig
+	rwc    *ckriprwc.ReadWriteCloser
+	tun    *tun.TunAdapter
+	mutex  sync.Mutex // Serialises changes to the TunnelRouting configuration
+	// Applies a TunnelRouting configuration to the running router, normally
+	// rwc.Reconfigure
+	reconfigure func(*config.TunnelRoutingConfig) error
 }
 
-func NewRestServer(server *restapi.RestServer, cfg *c.NodeConfig) (*restapi.RestServer, error) {
+func NewRestServer(server *restapi.RestServer, cfg *c.NodeConfig, rwc *ckriprwc.ReadWriteCloser, tun *tun.TunAdapter) (*restapi.RestServer, error) {
 	a := &RestServer{
-		server,
-		cfg,
+		server: server,
+		config: cfg,
+		rwc:    rwc,
+		tun:    tun,
 	}
+	a.reconfigure = rwc.Reconfigure
 	//add CKR for REST handlers here
 	a.server.AddHandler(restapi.ApiHandler{Method: "GET", Pattern: "/api/tunnelrouting", Desc: "Show TunnelRouting settings", Handler: a.getApiTunnelRouting})
-	a.server.AddHandler(restapi.ApiHandler{Method: "PUT", Pattern: "/api/tunnelrouting", Desc: "Set TunnelRouting settings", Handler: a.putApiTunnelRouting})
+	a.server.AddHandler(restapi.ApiHandler{Method: "PUT", Pattern: "/api/tunnelrouting", Desc: `Set TunnelRouting settings, changes take effect immediately
+Header "If-Match" with the ETag of the routing table refuses the change if the table has changed
+Request header "Riv-Save-Config: true" persists changes`, Handler: a.putApiTunnelRouting})
+	a.server.AddHandler(restapi.ApiHandler{Method: "GET", Pattern: "/api/tunnelrouting/routes", Desc: "Show active TunnelRouting routes and whether their destinations are reachable", Handler: a.getApiTunnelRoutingRoutes})
+	a.server.AddHandler(restapi.ApiHandler{Method: "POST", Pattern: "/api/tunnelrouting/routes", Desc: `Add a TunnelRouting route, e.g. { "prefix": "a.b.c.d/e", "key": "boxpubkey" }
+Header "If-Match" with the ETag of the routing table refuses the change if the table has changed
+Request header "Riv-Save-Config: true" persists changes`, Handler: a.postApiTunnelRoutingRoutes})
+	a.server.AddHandler(restapi.ApiHandler{Method: "PATCH", Pattern: "/api/tunnelrouting/routes/{prefix}", Desc: `Change the destination key of a TunnelRouting route, e.g. { "key": "boxpubkey" }
+Header "If-Match" with the ETag of the routing table refuses the change if the table has changed
+Request header "Riv-Save-Config: true" persists changes`, Handler: a.patchApiTunnelRoutingRoute})
+	a.server.AddHandler(restapi.ApiHandler{Method: "DELETE", Pattern: "/api/tunnelrouting/routes/{prefix}", Desc: `Remove a TunnelRouting route
+Header "If-Match" with the ETag of the routing table refuses the change if the table has changed
+Request header "Riv-Save-Config: true" persists changes`, Handler: a.deleteApiTunnelRoutingRoute})
+	a.server.AddHandler(restapi.ApiHandler{Method: "GET", Pattern: "/api/tunnelrouting/status", Desc: "Show the running TunnelRouting state: enabled state, active routes, cached keys and pending key lookups", Handler: a.getApiTunnelRoutingStatus})
+	a.server.AddHandler(restapi.ApiHandler{Method: "GET", Pattern: "/api/tunnelrouting/lookup/{address}", Desc: `Explain how packets to and from an address are handled: the mesh address or subnet or TunnelRouting route it belongs to, the key packets are sent to and the MTU
+Query parameter "key" checks whether packets from the address are accepted from that key`, Handler: a.getApiTunnelRoutingLookup})
+	a.server.AddHandler(restapi.ApiHandler{Method: "GET", Pattern: "/api/tunnelrouting/traffic", Desc: "Show the packets and bytes sent and received through each TunnelRouting route and remote key", Handler: a.getApiTunnelRoutingTraffic})
+	a.server.AddHandler(restapi.ApiHandler{Method: "DELETE", Pattern: "/api/tunnelrouting/traffic", Desc: "Reset the TunnelRouting traffic counters, returning their values before the reset", Handler: a.deleteApiTunnelRoutingTraffic})
+	a.server.AddHandler(restapi.ApiHandler{Method: "GET", Pattern: "/metrics", Desc: "Show VPN metrics in the Prometheus text format", Handler: a.getMetrics})
 	return a.server, nil
 }
 
@@ -35,7 +67,12 @@ func NewRestServer(server *restapi.RestServer, cfg *c.NodeConfig) (*restapi.Rest
 // @Failure		401		{error}		error		"Authentication failed"
 // @Router		/tunnelrouting [get]
 func (a *RestServer) getApiTunnelRouting(w http.ResponseWriter, r *http.Request) {
-	restapi.WriteJson(w, r, a.config.FeaturesConfig["TunnelRouting"])
+	// The settings and their ETag are read together so that they match
+	a.mutex.Lock()
+	cfg := a.tunnelRoutingConfig()
+	a.mutex.Unlock()
+	w.Header().Set("ETag", routesETag(&cfg))
+	restapi.WriteJson(w, r, cfg)
 }
 
 // @Summary		Set TunnelRouting settings.
@@ -53,7 +90,9 @@ func (a *RestServer) putApiTunnelRouting(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	if tunnelRouting.Enable {
-		if tunnelRouting.IPv4RemoteSubnets == nil && tunnelRouting.IPv6RemoteSubnets == nil {
+		if tunnelRouting.IPv4RemoteSubnets == nil && tunnelRouting.IPv6RemoteSubnets == nil &&
+			tunnelRouting.IPv4RemoteGateways == nil && tunnelRouting.IPv6RemoteGateways == nil &&
+			len(tunnelRouting.TrustedAnnouncers) == 0 && tunnelRouting.ControllerKey == "" {
 			http.Error(w, "IPv4RemoteSubnets and IPv6RemoteSubnets parameters are missing", http.StatusBadRequest)
 			return
 		}
@@ -94,12 +133,206 @@ func (a *RestServer) putApiTunnelRouting(w http.ResponseWriter, r *http.Request)
 			}
 		}
 	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if current := a.tunnelRoutingConfig(); !checkIfMatch(w, r, &current) {
+		return
+	}
+	if err := a.reconfigure(&tunnelRouting); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if a.config.FeaturesConfig == nil {
+		a.config.FeaturesConfig = map[string]interface{}{}
+	}
+	a.config.FeaturesConfig["TunnelRouting"] = tunnelRouting
+	saved := a.tunnelRoutingConfig()
+	w.Header().Set("ETag", routesETag(&saved))
 	w.WriteHeader(http.StatusNoContent)
 	a.saveConfig(func(cfg *c.NodeConfig) {
 		cfg.FeaturesConfig["TunnelRouting"] = tunnelRouting
 	}, r)
 }
 
+// @Summary		Show active TunnelRouting routes. The output contains following fields: Prefix, Key, Address, State, Last seen, Origin, Gateways
+// @Produce		json
+// @Success		200		{string}	string		"ok"
+// @Failure		400		{error}		error		"Method not allowed"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Router		/tunnelrouting/routes [get]
+func (a *RestServer) getApiTunnelRoutingRoutes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", a.currentRoutesETag())
+	routes := a.rwc.Routes()
+	result := make([]map[string]any, 0, len(routes))
+	for _, route := range routes {
+		addr := a.server.Core.AddrForKey(route.Destination())
+		entry := map[string]any{
+			"prefix":    route.Prefix.String(),
+			"key":       hex.EncodeToString(route.Destination()),
+			"address":   net.IP(addr[:]).String(),
+			"state":     route.State(),
+			"last_seen": nil,
+			"origin":    route.Origin(),
+		}
+		if seen := route.LastSeen(); !seen.IsZero() {
+			entry["last_seen"] = seen.UTC().Format(time.RFC3339)
+		}
+		gateways := make([]map[string]any, 0)
+		for _, g := range route.Gateways() {
+			gateway := map[string]any{
+				"key":       hex.EncodeToString(g.PublicKey),
+				"priority":  g.Priority,
+				"state":     g.State,
+				"last_seen": nil,
+			}
+			if !g.LastSeen.IsZero() {
+				gateway["last_seen"] = g.LastSeen.UTC().Format(time.RFC3339)
+			}
+			gateways = append(gateways, gateway)
+		}
+		entry["gateways"] = gateways
+		result = append(result, entry)
+	}
+	restapi.WriteJson(w, r, result)
+}
+
+// @Summary		Show the running TunnelRouting state, which may differ from the saved settings. The output contains following fields: Enabled, IPv4 routes, IPv6 routes, Keys, Lookups
+// @Produce		json
+// @Success		200		{string}	string		"ok"
+// @Failure		400		{error}		error		"Method not allowed"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Router		/tunnelrouting/status [get]
+func (a *RestServer) getApiTunnelRoutingStatus(w http.ResponseWriter, r *http.Request) {
+	keys := a.rwc.CachedKeys()
+	cached := make(map[string]ckriprwc.KeyStatus, len(keys))
+	for _, key := range keys {
+		cached[hex.EncodeToString(key.PublicKey)] = key
+	}
+	keyEntry := func(key ed25519.PublicKey) map[string]any {
+		addr := a.server.Core.AddrForKey(key)
+		entry := map[string]any{
+			"key":         hex.EncodeToString(key),
+			"address":     net.IP(addr[:]).String(),
+			"cached":      false,
+			"key_expires": nil,
+		}
+		if status, ok := cached[hex.EncodeToString(key)]; ok {
+			entry["cached"] = true
+			entry["key_expires"] = status.Expires.Seconds()
+		}
+		return entry
+	}
+	routes := func(v4 bool) []map[string]any {
+		routes := a.rwc.V6Routes()
+		if v4 {
+			routes = a.rwc.V4Routes()
+		}
+		result := make([]map[string]any, 0, len(routes))
+		for _, route := range routes {
+			entry := keyEntry(route.Destination())
+			entry["prefix"] = route.Prefix.String()
+			entry["origin"] = route.Origin()
+			entry["state"] = route.State()
+			entry["last_seen"] = nil
+			if seen := route.LastSeen(); !seen.IsZero() {
+				entry["last_seen"] = seen.UTC().Format(time.RFC3339)
+			}
+			gateways := make([]map[string]any, 0)
+			for _, g := range route.Gateways() {
+				gateway := keyEntry(g.PublicKey)
+				gateway["priority"] = g.Priority
+				gateway["state"] = g.State
+				gateway["last_seen"] = nil
+				if !g.LastSeen.IsZero() {
+					gateway["last_seen"] = g.LastSeen.UTC().Format(time.RFC3339)
+				}
+				gateways = append(gateways, gateway)
+			}
+			entry["gateways"] = gateways
+			result = append(result, entry)
+		}
+		return result
+	}
+	keyEntries := make([]map[string]any, 0, len(keys))
+	for _, key := range keys {
+		subnet := net.IPNet{IP: make(net.IP, net.IPv6len), Mask: net.CIDRMask(len(key.Subnet)*8, 128)}
+		copy(subnet.IP, key.Subnet[:])
+		keyEntries = append(keyEntries, map[string]any{
+			"key":     hex.EncodeToString(key.PublicKey),
+			"address": net.IP(key.Address[:]).String(),
+			"subnet":  subnet.String(),
+			"expires": key.Expires.Seconds(),
+		})
+	}
+	lookups := make([]map[string]any, 0)
+	for _, lookup := range a.rwc.PendingLookups() {
+		lookups = append(lookups, map[string]any{
+			"destination": lookup.Destination.String(),
+			"subnet":      lookup.Subnet,
+			"lookups":     lookup.Lookups,
+			"queued":      lookup.Queued,
+			"expires":     lookup.Expires.Seconds(),
+			"unreachable": lookup.Unreachable.Seconds(),
+		})
+	}
+	restapi.WriteJson(w, r, map[string]any{
+		"enabled":     a.rwc.Enabled(),
+		"ipv4_routes": routes(true),
+		"ipv6_routes": routes(false),
+		"keys":        keyEntries,
+		"lookups":     lookups,
+	})
+}
+
+// @Summary		Show TunnelRouting traffic counters. The output contains the routes and remote keys with their tx_packets, tx_bytes, rx_packets and rx_bytes
+// @Produce		json
+// @Success		200		{string}	string		"ok"
+// @Failure		400		{error}		error		"Method not allowed"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Router		/tunnelrouting/traffic [get]
+func (a *RestServer) getApiTunnelRoutingTraffic(w http.ResponseWriter, r *http.Request) {
+	restapi.WriteJson(w, r, a.trafficResult(a.rwc.Traffic(false)))
+}
+
+// @Summary		Reset TunnelRouting traffic counters. The output contains the counters as they were before the reset
+// @Produce		json
+// @Success		200		{string}	string		"ok"
+// @Failure		400		{error}		error		"Method not allowed"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Router		/tunnelrouting/traffic [delete]
+func (a *RestServer) deleteApiTunnelRoutingTraffic(w http.ResponseWriter, r *http.Request) {
+	restapi.WriteJson(w, r, a.trafficResult(a.rwc.Traffic(true)))
+}
+
+func (a *RestServer) trafficResult(traffic ckriprwc.Traffic) map[string]any {
+	counters := func(entry map[string]any, c ckriprwc.TrafficCounters) map[string]any {
+		entry["tx_packets"] = c.TxPackets
+		entry["tx_bytes"] = c.TxBytes
+		entry["rx_packets"] = c.RxPackets
+		entry["rx_bytes"] = c.RxBytes
+		return entry
+	}
+	routes := make([]map[string]any, 0, len(traffic.Routes))
+	for _, route := range traffic.Routes {
+		routes = append(routes, counters(map[string]any{
+			"prefix": route.Prefix.String(),
+			"active": route.Active,
+		}, route.TrafficCounters))
+	}
+	keys := make([]map[string]any, 0, len(traffic.Keys))
+	for _, key := range traffic.Keys {
+		addr := a.server.Core.AddrForKey(key.PublicKey)
+		keys = append(keys, counters(map[string]any{
+			"key":     hex.EncodeToString(key.PublicKey),
+			"address": net.IP(addr[:]).String(),
+		}, key.TrafficCounters))
+	}
+	return map[string]any{
+		"routes": routes,
+		"keys":   keys,
+	}
+}
+
 func (a *RestServer) saveConfig(setConfigFields func(*c.NodeConfig), r *http.Request) {
 	if len(a.server.ConfigFn) > 0 {
 		saveHeaders := r.Header["Riv-Save-Config"]
@@ -0,0 +1,294 @@
+package restapi
+
+// The routes module lets individual crypto-key routes be added, changed and
+// removed, instead of replacing the whole TunnelRouting configuration. Every
+// response carries an ETag for the configured routing table, and requests
+// with an If-Match header are refused if the table has changed since, so that
+// administrators editing at the same time don't overwrite each other.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	c "github.com/RiV-chain/RiV-mesh/src/config"
+	"github.com/RiV-chain/RiVPN/src/config"
+	"github.com/mitchellh/mapstructure"
+)
+
+const routesPath = "/api/tunnelrouting/routes/"
+
+// Returns a copy of the running TunnelRouting configuration, with its route
+// maps copied so that they can be changed.
+func (a *RestServer) tunnelRoutingConfig() config.TunnelRoutingConfig {
+	var cfg config.TunnelRoutingConfig
+	switch current := a.config.FeaturesConfig["TunnelRouting"].(type) {
+	case config.TunnelRoutingConfig:
+		cfg = current
+	case nil:
+	default:
+		_ = mapstructure.Decode(current, &cfg)
+	}
+	copySubnets := func(m map[string]string) map[string]string {
+		result := make(map[string]string, len(m))
+		for k, v := range m {
+			result[k] = v
+		}
+		return result
+	}
+	copyGateways := func(m map[string][]config.RemoteGateway) map[string][]config.RemoteGateway {
+		result := make(map[string][]config.RemoteGateway, len(m))
+		for k, v := range m {
+			result[k] = append([]config.RemoteGateway(nil), v...)
+		}
+		return result
+	}
+	cfg.IPv4RemoteSubnets = copySubnets(cfg.IPv4RemoteSubnets)
+	cfg.IPv6RemoteSubnets = copySubnets(cfg.IPv6RemoteSubnets)
+	cfg.IPv4RemoteGateways = copyGateways(cfg.IPv4RemoteGateways)
+	cfg.IPv6RemoteGateways = copyGateways(cfg.IPv6RemoteGateways)
+	return cfg
+}
+
+// Returns the ETag of the routing table in the given configuration.
+func routesETag(cfg *config.TunnelRoutingConfig) string {
+	bs, _ := json.Marshal([]any{
+		cfg.IPv4RemoteSubnets,
+		cfg.IPv6RemoteSubnets,
+		cfg.IPv4RemoteGateways,
+		cfg.IPv6RemoteGateways,
+	})
+	sum := sha256.Sum256(bs)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Checks the If-Match header of the request, if there is one, against the
+// ETag of the routing table in the given configuration. If it doesn't match
+// then the request is refused and false is returned.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, cfg *config.TunnelRoutingConfig) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	etag := routesETag(cfg)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	w.Header().Set("ETag", etag)
+	http.Error(w, "Routing table has changed", http.StatusPreconditionFailed)
+	return false
+}
+
+// Returns the subnet and gateway maps of the given configuration that routes
+// for the given prefix belong in.
+func routeMaps(cfg *config.TunnelRoutingConfig, prefix netip.Prefix) (map[string]string, map[string][]config.RemoteGateway) {
+	if prefix.Addr().Is4() {
+		return cfg.IPv4RemoteSubnets, cfg.IPv4RemoteGateways
+	}
+	return cfg.IPv6RemoteSubnets, cfg.IPv6RemoteGateways
+}
+
+// Finds the configured route for the given prefix, returning the key it is
+// stored under in the configuration and whether it is a gateway route.
+func findRoute(cfg *config.TunnelRoutingConfig, prefix netip.Prefix) (cidr string, gateways bool, found bool) {
+	subnets, gws := routeMaps(cfg, prefix)
+	for cidr := range subnets {
+		if p, err := netip.ParsePrefix(cidr); err == nil && p.Masked() == prefix {
+			return cidr, false, true
+		}
+	}
+	for cidr := range gws {
+		if p, err := netip.ParsePrefix(cidr); err == nil && p.Masked() == prefix {
+			return cidr, true, true
+		}
+	}
+	return "", false, false
+}
+
+// Parses a public key given in a request.
+func parseRouteKey(key string) (string, error) {
+	data, err := hex.DecodeString(key)
+	if err != nil || len(data) != 32 {
+		return "", fmt.Errorf("Public key is invalid")
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// Applies the given configuration to the running router and, if the request
+// asks for it, saves it to the configuration file. Writes an error and returns
+// false if the configuration can't be applied.
+func (a *RestServer) applyRoutes(w http.ResponseWriter, r *http.Request, cfg config.TunnelRoutingConfig) bool {
+	if err := a.reconfigure(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if a.config.FeaturesConfig == nil {
+		a.config.FeaturesConfig = map[string]interface{}{}
+	}
+	a.config.FeaturesConfig["TunnelRouting"] = cfg
+	a.saveConfig(func(nc *c.NodeConfig) {
+		if nc.FeaturesConfig == nil {
+			nc.FeaturesConfig = map[string]interface{}{}
+		}
+		nc.FeaturesConfig["TunnelRouting"] = cfg
+	}, r)
+	w.Header().Set("ETag", routesETag(&cfg))
+	return true
+}
+
+// @Summary		Add a TunnelRouting route. The request body contains the fields prefix and key. Supports If-Match with the ETag of the routing table.
+// Request header "Riv-Save-Config: true" persists changes
+// @Produce		json
+// @Success		201		{string}	string		"Created"
+// @Failure		400		{error}		error		"Bad request"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Failure		409		{error}		error		"Route already exists"
+// @Failure		412		{error}		error		"Routing table has changed"
+// @Router		/tunnelrouting/routes [post]
+func (a *RestServer) postApiTunnelRoutingRoutes(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Prefix string `json:"prefix"`
+		Key    string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix, err := netip.ParsePrefix(body.Prefix)
+	if err != nil {
+		http.Error(w, "Subnetwork is invalid", http.StatusBadRequest)
+		return
+	}
+	prefix = prefix.Masked()
+	key, err := parseRouteKey(body.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	cfg := a.tunnelRoutingConfig()
+	if !checkIfMatch(w, r, &cfg) {
+		return
+	}
+	if _, _, found := findRoute(&cfg, prefix); found {
+		http.Error(w, "Route already exists for "+prefix.String(), http.StatusConflict)
+		return
+	}
+	subnets, _ := routeMaps(&cfg, prefix)
+	subnets[prefix.String()] = key
+	if a.applyRoutes(w, r, cfg) {
+		w.Header().Set("Location", routesPath+prefix.String())
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Parses the prefix from the path of a request for a single route.
+func routePrefix(w http.ResponseWriter, r *http.Request) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(strings.TrimPrefix(r.URL.Path, routesPath))
+	if err != nil {
+		http.Error(w, "Subnetwork is invalid", http.StatusBadRequest)
+		return netip.Prefix{}, false
+	}
+	return prefix.Masked(), true
+}
+
+// @Summary		Change the destination key of a TunnelRouting route. The request body contains the field key. Supports If-Match with the ETag of the routing table.
+// Request header "Riv-Save-Config: true" persists changes
+// @Produce		json
+// @Success		204		{string}	string		"No content"
+// @Failure		400		{error}		error		"Bad request"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Failure		404		{error}		error		"Route not found"
+// @Failure		409		{error}		error		"Route has several gateways"
+// @Failure		412		{error}		error		"Routing table has changed"
+// @Router		/tunnelrouting/routes/{prefix} [patch]
+func (a *RestServer) patchApiTunnelRoutingRoute(w http.ResponseWriter, r *http.Request) {
+	prefix, ok := routePrefix(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := parseRouteKey(body.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	cfg := a.tunnelRoutingConfig()
+	if !checkIfMatch(w, r, &cfg) {
+		return
+	}
+	cidr, gateways, found := findRoute(&cfg, prefix)
+	switch {
+	case !found:
+		http.Error(w, "No route exists for "+prefix.String(), http.StatusNotFound)
+		return
+	case gateways:
+		http.Error(w, "Route for "+prefix.String()+" has several gateways, set them with PUT", http.StatusConflict)
+		return
+	}
+	subnets, _ := routeMaps(&cfg, prefix)
+	subnets[cidr] = key
+	if a.applyRoutes(w, r, cfg) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// @Summary		Remove a TunnelRouting route. Supports If-Match with the ETag of the routing table.
+// Request header "Riv-Save-Config: true" persists changes
+// @Produce		json
+// @Success		204		{string}	string		"No content"
+// @Failure		400		{error}		error		"Bad request"
+// @Failure		401		{error}		error		"Authentication failed"
+// @Failure		404		{error}		error		"Route not found"
+// @Failure		412		{error}		error		"Routing table has changed"
+// @Router		/tunnelrouting/routes/{prefix} [delete]
+func (a *RestServer) deleteApiTunnelRoutingRoute(w http.ResponseWriter, r *http.Request) {
+	prefix, ok := routePrefix(w, r)
+	if !ok {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	cfg := a.tunnelRoutingConfig()
+	if !checkIfMatch(w, r, &cfg) {
+		return
+	}
+	cidr, gateways, found := findRoute(&cfg, prefix)
+	if !found {
+		http.Error(w, "No route exists for "+prefix.String(), http.StatusNotFound)
+		return
+	}
+	subnets, gws := routeMaps(&cfg, prefix)
+	if gateways {
+		delete(gws, cidr)
+	} else {
+		delete(subnets, cidr)
+	}
+	if a.applyRoutes(w, r, cfg) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Returns the ETag of the configured routing table, for writing along with
+// the response to a GET request.
+func (a *RestServer) currentRoutesETag() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	cfg := a.tunnelRoutingConfig()
+	return routesETag(&cfg)
+}
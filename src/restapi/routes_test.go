@@ -0,0 +1,255 @@
+package restapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	c "github.com/RiV-chain/RiV-mesh/src/config"
+	"github.com/RiV-chain/RiV-mesh/src/restapi"
+	"github.com/RiV-chain/RiVPN/src/config"
+)
+
+const (
+	testKeyA = "1111111111111111111111111111111111111111111111111111111111111111"
+	testKeyB = "2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+// Returns a REST server whose configuration holds a route and a gateway
+// route, with Reconfigure stubbed out. The returned slice records every
+// configuration that has been applied.
+func newTestRestServer(t *testing.T) (*RestServer, *[]config.TunnelRoutingConfig) {
+	t.Helper()
+	applied := &[]config.TunnelRoutingConfig{}
+	a := &RestServer{
+		server: &restapi.RestServer{},
+		config: &c.NodeConfig{
+			FeaturesConfig: map[string]interface{}{
+				"TunnelRouting": config.TunnelRoutingConfig{
+					Enable:            true,
+					IPv4RemoteSubnets: map[string]string{"10.1.0.0/16": testKeyA},
+					IPv4RemoteGateways: map[string][]config.RemoteGateway{
+						"10.2.0.0/16": {{PublicKey: testKeyA}, {PublicKey: testKeyB}},
+					},
+				},
+			},
+		},
+	}
+	a.reconfigure = func(cfg *config.TunnelRoutingConfig) error {
+		*applied = append(*applied, *cfg)
+		return nil
+	}
+	return a, applied
+}
+
+func testRequest(method, path, body, ifMatch string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	return r
+}
+
+func TestRoutesETag(t *testing.T) {
+	a, _ := newTestRestServer(t)
+	cfg := a.tunnelRoutingConfig()
+	etag := routesETag(&cfg)
+	if again := a.tunnelRoutingConfig(); routesETag(&again) != etag {
+		t.Fatalf("ETag of an unchanged table changed")
+	}
+	cfg.IPv4RemoteSubnets["10.3.0.0/16"] = testKeyB
+	if routesETag(&cfg) == etag {
+		t.Fatalf("ETag didn't change with the table")
+	}
+	// Settings other than the routing table don't change the ETag
+	other := a.tunnelRoutingConfig()
+	other.Enable = false
+	other.IPv4LocalSubnets = []string{"192.168.1.0/24"}
+	if routesETag(&other) != etag {
+		t.Fatalf("ETag changed with settings other than the routing table")
+	}
+}
+
+func TestGetTunnelRouting(t *testing.T) {
+	a, _ := newTestRestServer(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			a.patchApiTunnelRoutingRoute(httptest.NewRecorder(), testRequest("PATCH", routesPath+"10.1.0.0/16", `{"key":"`+[]string{testKeyA, testKeyB}[i%2]+`"}`, ""))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		a.getApiTunnelRouting(w, testRequest("GET", "/api/tunnelrouting", "", ""))
+		var cfg config.TunnelRoutingConfig
+		if err := json.Unmarshal(w.Body.Bytes(), &cfg); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		if got := w.Header().Get("ETag"); got != routesETag(&cfg) {
+			t.Fatalf("got ETag %s, want the ETag of the returned table %s", got, routesETag(&cfg))
+		}
+	}
+	wg.Wait()
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	a, _ := newTestRestServer(t)
+	cfg := a.tunnelRoutingConfig()
+	etag := routesETag(&cfg)
+	for _, tc := range []struct {
+		ifMatch string
+		ok      bool
+	}{
+		{"", true},
+		{"*", true},
+		{etag, true},
+		{`"stale", ` + etag, true},
+		{`"stale"`, false},
+	} {
+		w := httptest.NewRecorder()
+		if ok := checkIfMatch(w, testRequest("DELETE", "/", "", tc.ifMatch), &cfg); ok != tc.ok {
+			t.Fatalf("If-Match %q: got %v, want %v", tc.ifMatch, ok, tc.ok)
+		}
+		if tc.ok {
+			continue
+		}
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("If-Match %q: got status %d, want %d", tc.ifMatch, w.Code, http.StatusPreconditionFailed)
+		}
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Fatalf("If-Match %q: got ETag %s, want %s", tc.ifMatch, got, etag)
+		}
+	}
+}
+
+func TestPostRoute(t *testing.T) {
+	a, applied := newTestRestServer(t)
+	etag := a.currentRoutesETag()
+
+	w := httptest.NewRecorder()
+	a.postApiTunnelRoutingRoutes(w, testRequest("POST", "/api/tunnelrouting/routes", `{"prefix":"10.3.1.0/16","key":"`+testKeyB+`"}`, etag))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if got := w.Header().Get("Location"); got != routesPath+"10.3.0.0/16" {
+		t.Fatalf("got Location %q", got)
+	}
+	if got := w.Header().Get("ETag"); got != a.currentRoutesETag() || got == etag {
+		t.Fatalf("got ETag %s, want the ETag of the changed table", got)
+	}
+	if len(*applied) != 1 || (*applied)[0].IPv4RemoteSubnets["10.3.0.0/16"] != testKeyB {
+		t.Fatalf("route wasn't applied: %v", *applied)
+	}
+	if cfg := a.tunnelRoutingConfig(); cfg.IPv4RemoteSubnets["10.3.0.0/16"] != testKeyB {
+		t.Fatalf("route wasn't stored in the configuration")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		body    string
+		ifMatch string
+		status  int
+	}{
+		{"stale If-Match", `{"prefix":"10.4.0.0/16","key":"` + testKeyB + `"}`, etag, http.StatusPreconditionFailed},
+		{"existing route", `{"prefix":"10.1.0.0/16","key":"` + testKeyB + `"}`, "", http.StatusConflict},
+		{"existing gateway route", `{"prefix":"10.2.0.0/16","key":"` + testKeyB + `"}`, "", http.StatusConflict},
+		{"invalid prefix", `{"prefix":"10.4.0.0","key":"` + testKeyB + `"}`, "", http.StatusBadRequest},
+		{"invalid key", `{"prefix":"10.4.0.0/16","key":"00"}`, "", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		a.postApiTunnelRoutingRoutes(w, testRequest("POST", "/api/tunnelrouting/routes", tc.body, tc.ifMatch))
+		if w.Code != tc.status {
+			t.Fatalf("%s: got status %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+	if len(*applied) != 1 {
+		t.Fatalf("refused requests were applied: %v", *applied)
+	}
+}
+
+func TestPatchRoute(t *testing.T) {
+	a, applied := newTestRestServer(t)
+	etag := a.currentRoutesETag()
+
+	w := httptest.NewRecorder()
+	a.patchApiTunnelRoutingRoute(w, testRequest("PATCH", routesPath+"10.1.2.3/16", `{"key":"`+testKeyB+`"}`, etag))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+	if cfg := a.tunnelRoutingConfig(); cfg.IPv4RemoteSubnets["10.1.0.0/16"] != testKeyB {
+		t.Fatalf("route wasn't changed: %v", cfg.IPv4RemoteSubnets)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		ifMatch string
+		status  int
+	}{
+		{"stale If-Match", "10.1.0.0/16", etag, http.StatusPreconditionFailed},
+		{"missing route", "10.4.0.0/16", "", http.StatusNotFound},
+		{"gateway route", "10.2.0.0/16", "", http.StatusConflict},
+		{"invalid prefix", "10.1.0.0", "", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		a.patchApiTunnelRoutingRoute(w, testRequest("PATCH", routesPath+tc.path, `{"key":"`+testKeyA+`"}`, tc.ifMatch))
+		if w.Code != tc.status {
+			t.Fatalf("%s: got status %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+	if len(*applied) != 1 {
+		t.Fatalf("refused requests were applied: %v", *applied)
+	}
+}
+
+func TestDeleteRoute(t *testing.T) {
+	a, applied := newTestRestServer(t)
+	etag := a.currentRoutesETag()
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		ifMatch string
+		status  int
+	}{
+		{"route", "10.1.0.0/16", etag, http.StatusNoContent},
+		{"stale If-Match", "10.2.0.0/16", etag, http.StatusPreconditionFailed},
+		{"gateway route", "10.2.0.0/16", "", http.StatusNoContent},
+		{"missing route", "10.1.0.0/16", "", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		a.deleteApiTunnelRoutingRoute(w, testRequest("DELETE", routesPath+tc.path, "", tc.ifMatch))
+		if w.Code != tc.status {
+			t.Fatalf("%s: got status %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+	cfg := a.tunnelRoutingConfig()
+	if len(cfg.IPv4RemoteSubnets) != 0 || len(cfg.IPv4RemoteGateways) != 0 {
+		t.Fatalf("routes weren't removed: %v %v", cfg.IPv4RemoteSubnets, cfg.IPv4RemoteGateways)
+	}
+	if len(*applied) != 2 {
+		t.Fatalf("got %d applied configurations, want 2", len(*applied))
+	}
+}
+
+func TestRouteReconfigureError(t *testing.T) {
+	a, _ := newTestRestServer(t)
+	etag := a.currentRoutesETag()
+	a.reconfigure = func(*config.TunnelRoutingConfig) error {
+		return errors.New("rejected")
+	}
+	w := httptest.NewRecorder()
+	a.deleteApiTunnelRoutingRoute(w, testRequest("DELETE", routesPath+"10.1.0.0/16", "", ""))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if a.currentRoutesETag() != etag {
+		t.Fatalf("rejected configuration was stored")
+	}
+}
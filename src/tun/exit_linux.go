@@ -0,0 +1,230 @@
+//go:build !mobile
+// +build !mobile
+
+package tun
+
+// The exit client parts for Linux. While there is a crypto-key route for a
+// default route, it is installed as two /1 routes which override the system's
+// default route without replacing it, and host routes keep the connections to
+// our peers going through the original gateway rather than into the tunnel.
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Returns the prefixes which the CKR route for the given prefix is installed
+// as. In exit client mode a default route is split into two /1 routes.
+func (tun *TunAdapter) installedPrefixes(prefix netip.Prefix) []netip.Prefix {
+	if !tun.config.exitClient || prefix.Bits() != 0 {
+		return []netip.Prefix{prefix}
+	}
+	if prefix.Addr().Is4() {
+		return []netip.Prefix{
+			netip.MustParsePrefix("0.0.0.0/1"),
+			netip.MustParsePrefix("128.0.0.0/1"),
+		}
+	}
+	return []netip.Prefix{
+		netip.MustParsePrefix("::/1"),
+		netip.MustParsePrefix("8000::/1"),
+	}
+}
+
+// How long the endpoint of a peer which has gone is kept out of the tunnel, so
+// that the peer can reconnect.
+const endpointExpiry = 10 * time.Minute
+
+// How often the host names of the configured peers are resolved again.
+const endpointResolveInterval = 5 * time.Minute
+
+// Adds the endpoints of the currently connected peers to the endpoints which
+// are kept out of the tunnel. Endpoints of peers which have gone are kept for
+// a while, so that they can reconnect, and are then expired.
+func (tun *TunAdapter) updateEndpoints() {
+	now := time.Now()
+	for _, peer := range tun.core.GetPeers() {
+		if addr, err := netip.ParseAddr(peer.RemoteIp); err == nil {
+			tun.endpoints[addr.WithZone("").Unmap()] = now
+		}
+	}
+	for addr, seen := range tun.endpoints {
+		if now.Sub(seen) > endpointExpiry {
+			delete(tun.endpoints, addr)
+		}
+	}
+}
+
+// Returns the endpoints which are kept out of the tunnel: those of the
+// configured peers and those of peers which are or were recently connected.
+func (tun *TunAdapter) peerEndpoints() []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(tun.resolved)+len(tun.endpoints))
+	for addr := range tun.resolved {
+		addrs = append(addrs, addr)
+	}
+	for addr := range tun.endpoints {
+		if _, ok := tun.resolved[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Resolves the host names and addresses of the configured peers. Peers which
+// can't be resolved are skipped, as they are picked up once they connect.
+func (tun *TunAdapter) resolveEndpoints() map[netip.Addr]struct{} {
+	resolved := make(map[netip.Addr]struct{})
+	for _, host := range tun.config.endpoints {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			resolved[addr.WithZone("").Unmap()] = struct{}{}
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			tun.log.Warnln("Unable to resolve peer", host, ":", err)
+			continue
+		}
+		for _, ip := range ips {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				resolved[addr.Unmap()] = struct{}{}
+			}
+		}
+	}
+	return resolved
+}
+
+// Resolves the configured peers again every endpointResolveInterval, so that
+// the routes and kill switch follow changes to their host names. Runs until
+// done is closed.
+func (tun *TunAdapter) watchEndpoints(done chan struct{}) {
+	ticker := time.NewTicker(endpointResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		resolved := tun.resolveEndpoints()
+		tun.Act(nil, func() {
+			if !reflect.DeepEqual(resolved, tun.resolved) {
+				tun.resolved = resolved
+				tun._updateRoutes()
+			}
+		})
+	}
+}
+
+// Brings the host routes for our peers' endpoints in line with the known
+// endpoints. If exiting is false then all of them are deleted.
+func (tun *TunAdapter) reconcileHostRoutes(link netlink.Link, exiting bool) {
+	desired := make(map[netip.Addr]*netlink.Route)
+	if exiting {
+		for _, addr := range tun.peerEndpoints() {
+			if !addr.IsGlobalUnicast() || addr.IsLinkLocalUnicast() {
+				continue // Never routed through a gateway
+			}
+			if route := tun.hostRoute(link, addr); route != nil {
+				desired[addr] = route
+			}
+		}
+	}
+	installed := make(map[netip.Addr]struct{}, len(desired))
+	for _, route := range tun.ownHostRoutes(link) {
+		addr := routePrefix(&route).Addr()
+		if want := desired[addr]; want != nil && sameNextHop(want, &route) {
+			if _, ok := installed[addr]; !ok {
+				installed[addr] = struct{}{}
+				continue
+			}
+		}
+		if err := netlink.RouteDel(&route); err != nil {
+			tun.log.Errorln("Unable to delete host route for", addr, ":", err)
+		}
+	}
+	for addr, route := range desired {
+		if _, ok := installed[addr]; ok {
+			continue
+		}
+		if err := netlink.RouteAdd(route); err != nil {
+			tun.log.Errorln("Unable to add host route for", addr, ":", err)
+			continue
+		}
+		tun.log.Debugln("Added host route for peer endpoint", addr)
+	}
+}
+
+// Returns a host route for the given peer endpoint through the system's
+// default gateway, or nil if the endpoint doesn't need one because a more
+// specific route than the default route leads to it, e.g. because it is on
+// the local network.
+func (tun *TunAdapter) hostRoute(link netlink.Link, addr netip.Addr) *netlink.Route {
+	family, bits := netlink.FAMILY_V4, 32
+	if addr.Is6() {
+		family, bits = netlink.FAMILY_V6, 128
+	}
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		tun.log.Errorln("Unable to list routes:", err)
+		return nil
+	}
+	var gateway *netlink.Route
+	for i := range routes {
+		route := &routes[i]
+		if route.LinkIndex == link.Attrs().Index || route.Protocol == tun.routeProtocol() {
+			continue
+		}
+		if route.Dst == nil {
+			if gateway == nil || route.Priority < gateway.Priority {
+				gateway = route
+			}
+		} else if ones, _ := route.Dst.Mask.Size(); ones > 0 && route.Dst.Contains(net.IP(addr.AsSlice())) {
+			return nil
+		}
+	}
+	if gateway == nil {
+		return nil
+	}
+	return &netlink.Route{
+		LinkIndex: gateway.LinkIndex,
+		Dst:       prefixIPNet(netip.PrefixFrom(addr, bits)),
+		Gw:        gateway.Gw,
+		MultiPath: gateway.MultiPath,
+		Protocol:  tun.routeProtocol(),
+		Priority:  int(tun.config.metric),
+		Table:     tun.routeTable(),
+	}
+}
+
+// Returns the host routes that we installed, which are the routes in our
+// routing table with our protocol ID which don't go through the TUN link.
+func (tun *TunAdapter) ownHostRoutes(link netlink.Link) []netlink.Route {
+	filter := &netlink.Route{
+		Protocol: tun.routeProtocol(),
+		Table:    tun.routeTable(),
+	}
+	var routes []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rs, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			tun.log.Errorln("Unable to list routes:", err)
+			continue
+		}
+		for _, route := range rs {
+			if route.LinkIndex != link.Attrs().Index && route.Dst != nil {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes
+}
+
+// Checks whether two routes go through the same gateway.
+func sameNextHop(a, b *netlink.Route) bool {
+	return a.LinkIndex == b.LinkIndex && a.Gw.Equal(b.Gw) && len(a.MultiPath) == len(b.MultiPath)
+}
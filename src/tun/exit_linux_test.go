@@ -0,0 +1,58 @@
+//go:build !mobile
+// +build !mobile
+
+package tun
+
+import (
+	"crypto/ed25519"
+	"io"
+	"net/netip"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/RiV-chain/RiV-mesh/src/core"
+)
+
+func TestPeerEndpoints(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := core.New(sk, log.New(io.Discard, "", 0), core.NetworkDomain{Prefix: "fc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+
+	recent := netip.MustParseAddr("192.0.2.1")
+	expired := netip.MustParseAddr("192.0.2.2")
+	tun := &TunAdapter{
+		core: c,
+		log:  log.New(io.Discard, "", 0),
+		endpoints: map[netip.Addr]time.Time{
+			recent:  time.Now().Add(-time.Minute),
+			expired: time.Now().Add(-endpointExpiry - time.Minute),
+		},
+	}
+	tun.config.endpoints = []string{"198.51.100.1", "::ffff:198.51.100.2", "2001:db8::1", "192.0.2.1"}
+	tun.resolved = tun.resolveEndpoints()
+	tun.updateEndpoints()
+
+	var got []string
+	for _, addr := range tun.peerEndpoints() {
+		got = append(got, addr.String())
+	}
+	sort.Strings(got)
+	expected := []string{"192.0.2.1", "198.51.100.1", "198.51.100.2", "2001:db8::1"}
+	if len(got) != len(expected) {
+		t.Fatalf("Got endpoints %v, expected %v", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Got endpoints %v, expected %v", got, expected)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package tun
 
+import "sync/atomic"
+
 const TUN_OFFSET_BYTES = 4
 
 func (tun *TunAdapter) read() {
@@ -7,6 +9,7 @@ func (tun *TunAdapter) read() {
 	for {
 		n, err := tun.iface.Read(buf[:], TUN_OFFSET_BYTES)
 		if n <= TUN_OFFSET_BYTES || err != nil {
+			atomic.AddUint64(&tun.readErrs, 1)
 			tun.log.Errorln("Error reading TUN:", err)
 			ferr := tun.iface.Flush()
 			if ferr != nil {
@@ -40,6 +43,7 @@ func (tun *TunAdapter) write() {
 		}
 		bs = buf[:TUN_OFFSET_BYTES+n]
 		if _, err = tun.iface.Write(bs, TUN_OFFSET_BYTES); err != nil {
+			atomic.AddUint64(&tun.writeErrs, 1)
 			tun.Act(nil, func() {
 				if !tun.isOpen {
 					tun.log.Errorln("TUN iface write error:", err)
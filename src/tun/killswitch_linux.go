@@ -0,0 +1,132 @@
+//go:build !mobile
+// +build !mobile
+
+package tun
+
+// The kill switch for Linux. While there is a configured crypto-key route for
+// a default route, traffic which would leave through any interface other than
+// the TUN adapter is dropped, whether it is sent or forwarded by this host,
+// apart from traffic to our peers, loopback and the local networks, so that
+// nothing leaks onto the physical network when the mesh goes down.
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/RiV-chain/RiVPN/src/ckriprwc"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The nftables table that the kill switch rules are kept in.
+const killSwitchTable = "rivpn_killswitch"
+
+// Prefixes which are always allowed, for neighbour discovery, DHCP, multicast
+// peer discovery and the like.
+var killSwitchLocal = []netip.Prefix{
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// Turns the kill switch on if it is enabled and there is a configured CKR
+// route for a default route, and off otherwise. Default routes which are
+// learned from announcers or a route controller don't count, as they can
+// expire and would turn the kill switch off without anyone having asked for
+// it. While it is on, its rules are kept in line with our peers and the
+// local networks.
+func (tun *TunAdapter) updateKillSwitch(link netlink.Link) {
+	exiting := false
+	for _, r := range append(tun.rwc.V4Routes(), tun.rwc.V6Routes()...) {
+		exiting = exiting || r.Prefix.Bits() == 0 && r.Origin() == ckriprwc.RouteConfigured
+	}
+	if !tun.config.killSwitch || !exiting {
+		tun.removeKillSwitch()
+		return
+	}
+	allowed := append([]netip.Prefix(nil), killSwitchLocal...)
+	allowed = append(allowed, tun.config.allow...)
+	allowed = append(allowed, tun.localNetworks(link)...)
+	for _, addr := range tun.peerEndpoints() {
+		allowed = append(allowed, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	allowed4, allowed6 := nftElements(allowed)
+	ruleset := killSwitchRuleset(tun.Name(), allowed4, allowed6)
+	if ruleset == tun.killRules {
+		return
+	}
+	script := fmt.Sprintf("add table inet %s\ndelete table inet %s\n%s", killSwitchTable, killSwitchTable, ruleset)
+	if err := runNft(script); err != nil {
+		tun.log.Errorln("Unable to turn on the kill switch:", err)
+		return
+	}
+	if tun.killRules == "" {
+		tun.log.Infoln("Kill switch is on, traffic outside", tun.Name(), "is blocked")
+	}
+	tun.killRules = ruleset
+}
+
+// Turns the kill switch off.
+func (tun *TunAdapter) removeKillSwitch() {
+	if tun.killRules == "" {
+		return
+	}
+	if err := runNft(fmt.Sprintf("delete table inet %s\n", killSwitchTable)); err != nil {
+		tun.log.Errorln("Unable to turn off the kill switch:", err)
+		return
+	}
+	tun.killRules = ""
+	tun.log.Infoln("Kill switch is off")
+}
+
+// Returns the networks which are directly connected to interfaces other than
+// the TUN adapter, which are the routes in the main table without a gateway.
+func (tun *TunAdapter) localNetworks(link netlink.Link) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			tun.log.Errorln("Unable to list routes:", err)
+			continue
+		}
+		for i := range routes {
+			route := &routes[i]
+			if route.Dst == nil || route.Gw != nil || len(route.MultiPath) > 0 ||
+				route.LinkIndex == link.Attrs().Index || route.Type != unix.RTN_UNICAST {
+				continue
+			}
+			prefixes = append(prefixes, routePrefix(route))
+		}
+	}
+	return prefixes
+}
+
+// Returns an nftables table which drops all outgoing and forwarded traffic
+// except through loopback or the given interface, or to the given addresses.
+func killSwitchRuleset(ifname string, allowed4, allowed6 []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", killSwitchTable)
+	fmt.Fprintf(&b, "\tset allowed4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n")
+	if len(allowed4) > 0 {
+		fmt.Fprintf(&b, "\t\telements = { %s }\n", strings.Join(allowed4, ", "))
+	}
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "\tset allowed6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n")
+	if len(allowed6) > 0 {
+		fmt.Fprintf(&b, "\t\telements = { %s }\n", strings.Join(allowed6, ", "))
+	}
+	fmt.Fprintf(&b, "\t}\n")
+	for _, hook := range []string{"output", "forward"} {
+		fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook %s priority 0; policy drop;\n", hook, hook)
+		fmt.Fprintf(&b, "\t\toifname \"lo\" accept\n")
+		fmt.Fprintf(&b, "\t\toifname %q accept\n", ifname)
+		fmt.Fprintf(&b, "\t\tip daddr @allowed4 accept\n")
+		fmt.Fprintf(&b, "\t\tip6 daddr @allowed6 accept\n")
+		fmt.Fprintf(&b, "\t}\n")
+	}
+	fmt.Fprintf(&b, "}\n")
+	return b.String()
+}
@@ -0,0 +1,37 @@
+//go:build !mobile
+// +build !mobile
+
+package tun
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKillSwitchRuleset(t *testing.T) {
+	ruleset := killSwitchRuleset("tun0", []string{"192.0.2.1/32", "192.168.0.0/24"}, []string{"2001:db8::1/128"})
+	for _, s := range []string{
+		"elements = { 192.0.2.1/32, 192.168.0.0/24 }",
+		"elements = { 2001:db8::1/128 }",
+		"type filter hook output priority 0; policy drop;",
+		"type filter hook forward priority 0; policy drop;",
+	} {
+		if !strings.Contains(ruleset, s) {
+			t.Errorf("Ruleset doesn't contain %q:\n%s", s, ruleset)
+		}
+	}
+	// Both chains let the same traffic through
+	for _, s := range []string{
+		`oifname "lo" accept`,
+		`oifname "tun0" accept`,
+		"ip daddr @allowed4 accept",
+		"ip6 daddr @allowed6 accept",
+	} {
+		if n := strings.Count(ruleset, s); n != 2 {
+			t.Errorf("Ruleset contains %q %d times, expected 2:\n%s", s, n, ruleset)
+		}
+	}
+	if strings.Contains(killSwitchRuleset("tun0", nil, nil), "elements") {
+		t.Error("Expected empty sets without elements")
+	}
+}
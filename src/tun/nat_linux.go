@@ -0,0 +1,175 @@
+//go:build !mobile
+// +build !mobile
+
+package tun
+
+// The exit server parts for Linux. Forwarding is enabled and traffic from the
+// remote subnets that arrives on the TUN adapter, which has already been
+// authenticated by crypto-key routing, is masqueraded behind the address of
+// the interface it leaves through.
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// The nftables table that the masquerade rules are kept in.
+const natTable = "rivpn_nat"
+
+// The kernel settings which enable IPv4 and IPv6 forwarding globally. The
+// kernel only forwards IPv6 packets if it is enabled for all interfaces.
+const (
+	ipv4Forwarding = "/proc/sys/net/ipv4/ip_forward"
+	ipv6Forwarding = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+// Returns the kernel settings which enable forwarding for the given
+// interface. The global IPv4 setting comes first, as changing it resets the
+// setting of every interface.
+func forwardingSysctls(ifname string) []string {
+	return []string{
+		ipv4Forwarding,
+		"/proc/sys/net/ipv4/conf/" + ifname + "/forwarding",
+		ipv6Forwarding,
+		"/proc/sys/net/ipv6/conf/" + ifname + "/forwarding",
+	}
+}
+
+// Enables forwarding and brings the masquerade rules in line with the current
+// CKR routes, if exit server mode is enabled.
+func (tun *TunAdapter) updateNAT() {
+	if !tun.config.exitServer {
+		return
+	}
+	if tun.sysctls == nil {
+		tun.sysctls = make(map[string]string)
+		for _, path := range forwardingSysctls(tun.Name()) {
+			old, err := os.ReadFile(path)
+			if err != nil {
+				tun.log.Errorln("Unable to enable forwarding:", err)
+				continue
+			}
+			if strings.TrimSpace(string(old)) == "1" {
+				continue
+			}
+			if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+				tun.log.Errorln("Unable to enable forwarding:", err)
+				continue
+			}
+			tun.sysctls[path] = string(old)
+		}
+	}
+	var sources []netip.Prefix
+	for _, r := range append(tun.rwc.V4Routes(), tun.rwc.V6Routes()...) {
+		sources = append(sources, r.Prefix)
+	}
+	sources4, sources6 := nftElements(sources)
+	ruleset := natRuleset(tun.Name(), sources4, sources6)
+	if ruleset == tun.ruleset {
+		return
+	}
+	// Creating the table first means that deleting it never fails, so that
+	// the old rules are replaced in the same transaction
+	script := fmt.Sprintf("add table inet %s\ndelete table inet %s\n%s", natTable, natTable, ruleset)
+	if err := runNft(script); err != nil {
+		tun.log.Errorln("Unable to install masquerade rules:", err)
+		return
+	}
+	tun.ruleset = ruleset
+}
+
+// Deletes the masquerade rules and restores the forwarding settings.
+func (tun *TunAdapter) removeNAT() {
+	if tun.ruleset != "" {
+		if err := runNft(fmt.Sprintf("delete table inet %s\n", natTable)); err != nil {
+			tun.log.Errorln("Unable to delete masquerade rules:", err)
+		}
+		tun.ruleset = ""
+	}
+	// The settings are restored in the reverse of the order they were changed
+	// in, so that each is put back to the state it was changed from
+	paths := forwardingSysctls(tun.Name())
+	for i := len(paths) - 1; i >= 0; i-- {
+		old, ok := tun.sysctls[paths[i]]
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(paths[i], []byte(old), 0644); err != nil {
+			tun.log.Errorln("Unable to restore", paths[i], ":", err)
+		}
+	}
+	tun.sysctls = nil
+}
+
+// Returns an nftables table which accepts and masquerades traffic from the
+// given source prefixes that arrives on the given interface and leaves through
+// another. Other traffic is left to the rest of the firewall.
+func natRuleset(ifname string, sources4, sources6 []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", natTable)
+	fmt.Fprintf(&b, "\tset sources4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n")
+	if len(sources4) > 0 {
+		fmt.Fprintf(&b, "\t\telements = { %s }\n", strings.Join(sources4, ", "))
+	}
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "\tset sources6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n")
+	if len(sources6) > 0 {
+		fmt.Fprintf(&b, "\t\telements = { %s }\n", strings.Join(sources6, ", "))
+	}
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "\tchain forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q oifname != %q ip saddr @sources4 accept\n", ifname, ifname)
+	fmt.Fprintf(&b, "\t\tiifname %q oifname != %q ip6 saddr @sources6 accept\n", ifname, ifname)
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "\tchain postrouting {\n\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q oifname != %q ip saddr @sources4 masquerade\n", ifname, ifname)
+	fmt.Fprintf(&b, "\t\tiifname %q oifname != %q ip6 saddr @sources6 masquerade\n", ifname, ifname)
+	fmt.Fprintf(&b, "\t}\n}\n")
+	return b.String()
+}
+
+// Applies the given nftables script in one transaction.
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Returns the given prefixes as IPv4 and IPv6 elements of nftables interval
+// sets. Prefixes within other prefixes are left out, as the elements of an
+// interval set must not overlap.
+func nftElements(prefixes []netip.Prefix) (v4, v6 []string) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Bits() != prefixes[j].Bits() {
+			return prefixes[i].Bits() < prefixes[j].Bits()
+		}
+		return prefixes[i].Addr().Less(prefixes[j].Addr())
+	})
+	var kept []netip.Prefix
+	for _, prefix := range prefixes {
+		covered := false
+		for _, k := range kept {
+			if k.Bits() <= prefix.Bits() && k.Contains(prefix.Addr()) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		kept = append(kept, prefix)
+		if prefix.Addr().Is4() {
+			v4 = append(v4, prefix.String())
+		} else {
+			v6 = append(v6, prefix.String())
+		}
+	}
+	return v4, v6
+}
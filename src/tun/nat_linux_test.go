@@ -0,0 +1,78 @@
+//go:build !mobile
+// +build !mobile
+
+package tun
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestNftElements(t *testing.T) {
+	for _, tc := range []struct {
+		prefixes []string
+		v4, v6   string
+	}{
+		{nil, "", ""},
+		{[]string{"10.1.0.0/16", "192.168.0.0/24"}, "10.1.0.0/16, 192.168.0.0/24", ""},
+		{[]string{"192.168.0.0/24", "10.1.0.0/16"}, "10.1.0.0/16, 192.168.0.0/24", ""},
+		{[]string{"10.1.2.0/24", "10.1.0.0/16", "10.1.2.3/32"}, "10.1.0.0/16", ""},
+		{[]string{"10.1.0.0/16", "10.1.0.0/16"}, "10.1.0.0/16", ""},
+		{[]string{"10.2.0.0/16", "10.0.0.0/8", "0.0.0.0/0"}, "0.0.0.0/0", ""},
+		{[]string{"2001:db8:1::/48", "2001:db8::/32", "10.1.0.0/16"}, "10.1.0.0/16", "2001:db8::/32"},
+		{[]string{"2001:db8:1::/48", "2001:db8:2::/48"}, "", "2001:db8:1::/48, 2001:db8:2::/48"},
+	} {
+		var prefixes []netip.Prefix
+		for _, s := range tc.prefixes {
+			prefixes = append(prefixes, netip.MustParsePrefix(s))
+		}
+		v4, v6 := nftElements(prefixes)
+		if strings.Join(v4, ", ") != tc.v4 || strings.Join(v6, ", ") != tc.v6 {
+			t.Errorf("%v: got %v and %v, expected %s and %s", tc.prefixes, v4, v6, tc.v4, tc.v6)
+		}
+	}
+}
+
+func TestNatRuleset(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		sources4         []string
+		sources6         []string
+		contains, absent []string
+	}{
+		{
+			name:     "sources",
+			sources4: []string{"10.1.0.0/16"},
+			sources6: []string{"2001:db8::/32"},
+			contains: []string{
+				"elements = { 10.1.0.0/16 }",
+				"elements = { 2001:db8::/32 }",
+				`iifname "tun0" oifname != "tun0" ip saddr @sources4 masquerade`,
+				`iifname "tun0" oifname != "tun0" ip6 saddr @sources6 masquerade`,
+				`iifname "tun0" oifname != "tun0" ip saddr @sources4 accept`,
+				`iifname "tun0" oifname != "tun0" ip6 saddr @sources6 accept`,
+			},
+		},
+		{
+			name:   "no sources",
+			absent: []string{"elements"},
+		},
+	} {
+		ruleset := natRuleset("tun0", tc.sources4, tc.sources6)
+		for _, s := range tc.contains {
+			if !strings.Contains(ruleset, s) {
+				t.Errorf("%s: ruleset doesn't contain %q:\n%s", tc.name, s, ruleset)
+			}
+		}
+		for _, s := range tc.absent {
+			if strings.Contains(ruleset, s) {
+				t.Errorf("%s: ruleset contains %q:\n%s", tc.name, s, ruleset)
+			}
+		}
+		// Other traffic to, from or through the interface isn't dropped
+		if strings.Contains(ruleset, "drop") {
+			t.Errorf("%s: ruleset drops traffic:\n%s", tc.name, ruleset)
+		}
+	}
+}
@@ -1,11 +1,31 @@
 package tun
 
+import "net/netip"
+
 func (m *TunAdapter) _applyOption(opt SetupOption) {
 	switch v := opt.(type) {
 	case InterfaceName:
 		m.config.name = v
 	case InterfaceMTU:
 		m.config.mtu = v
+	case RouteTable:
+		m.config.table = v
+	case RouteMetric:
+		m.config.metric = v
+	case RouteProtocol:
+		m.config.protocol = v
+	case RoutingRule:
+		m.config.rules = append(m.config.rules, v)
+	case ExitClient:
+		m.config.exitClient = bool(v)
+	case ExitServer:
+		m.config.exitServer = bool(v)
+	case KillSwitch:
+		m.config.killSwitch = bool(v)
+	case KillSwitchAllow:
+		m.config.allow = append(m.config.allow, netip.Prefix(v))
+	case PeerEndpoint:
+		m.config.endpoints = append(m.config.endpoints, string(v))
 	}
 }
 
@@ -16,5 +36,68 @@ type SetupOption interface {
 type InterfaceName string
 type InterfaceMTU uint64
 
-func (a InterfaceName) isSetupOption() {}
-func (a InterfaceMTU) isSetupOption()  {}
+// RouteTable is the ID of the routing table that the CKR routes are installed
+// into, instead of the main table. It must be set for routing rules to be
+// installed. Only used on Linux.
+type RouteTable int
+
+// RouteMetric is the metric (priority) of the CKR routes. Lower values are
+// preferred. Only used on Linux.
+type RouteMetric int
+
+// RouteProtocol is the protocol ID that the CKR routes are installed with,
+// which is how they are told apart from other routes. Defaults to 82. Only
+// used on Linux.
+type RouteProtocol int
+
+// RoutingRule is a policy routing rule which sends traffic with the given
+// fwmark, or from the given source prefix, to the CKR routing table. If both
+// are set then traffic must match both. The option can be given several
+// times to install several rules. Only used on Linux.
+type RoutingRule struct {
+	Mark     uint32       // The fwmark to match, or 0 to match any
+	Mask     uint32       // The mask applied to the fwmark, or 0 to match it exactly
+	Source   netip.Prefix // The source prefix to match, if valid
+	Priority int          // The priority of the rule, or 0 for the default of 5282
+}
+
+// ExitClient enables exit client mode: while there is a crypto-key route for
+// 0.0.0.0/0 or ::/0, it is installed as two /1 routes through the TUN adapter,
+// and host routes through the original gateway are added for the endpoints of
+// our peers so that peering traffic doesn't loop into the tunnel. Only used on
+// Linux.
+type ExitClient bool
+
+// ExitServer enables exit server mode: forwarding is enabled, and traffic from
+// the remote subnets which arrives on the TUN adapter is masqueraded when it
+// leaves through another interface, using nftables. Only used on Linux.
+type ExitServer bool
+
+// KillSwitch blocks all traffic, sent or forwarded, which would leave through
+// an interface other than the TUN adapter while there is a configured
+// crypto-key route for 0.0.0.0/0 or ::/0, so that nothing leaks when the mesh
+// is down. Traffic to our peers, loopback and the local networks is still
+// allowed. Uses nftables and is only used on Linux.
+type KillSwitch bool
+
+// KillSwitchAllow is a prefix which may still be reached outside the tunnel
+// while the kill switch is on. The option can be given several times.
+type KillSwitchAllow netip.Prefix
+
+// PeerEndpoint is the host name or address of a peer which is kept out of the
+// tunnel in exit client mode, and allowed through the kill switch, even before
+// a connection to it has been established. Host names are resolved again
+// periodically. The endpoints of connected peers are found automatically.
+type PeerEndpoint string
+
+func (a InterfaceName) isSetupOption()   {}
+func (a InterfaceMTU) isSetupOption()    {}
+func (a RouteTable) isSetupOption()      {}
+func (a RouteMetric) isSetupOption()     {}
+func (a RouteProtocol) isSetupOption()   {}
+func (a RoutingRule) isSetupOption()     {}
+func (a ExitClient) isSetupOption()      {}
+func (a PeerEndpoint) isSetupOption()    {}
+func (a ExitServer) isSetupOption()      {}
+func (a KillSwitch) isSetupOption()      {}
+func (a KillSwitchAllow) isSetupOption() {}
@@ -9,6 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
 
 	"github.com/Arceliar/phony"
 	"github.com/RiV-chain/RiVPN/src/ckriprwc"
@@ -35,10 +38,29 @@ type TunAdapter struct {
 	phony.Inbox // Currently only used for _handlePacket from the reader, TODO: all the stuff that currently needs a mutex below
 	//mutex        sync.RWMutex // Protects the below
 	isOpen    bool
-	isEnabled bool // Used by the writer to drop sessionTraffic if not enabled
+	isEnabled bool                      // Used by the writer to drop sessionTraffic if not enabled
+	routes    map[netip.Prefix]struct{} // CKR routes installed into the system routing table
+	readErrs  uint64                    // Failed reads from the TUN interface, accessed atomically
+	writeErrs uint64                    // Failed writes to the TUN interface, accessed atomically
+	done      chan struct{}             // Closed when the adapter is stopped
+	endpoints map[netip.Addr]time.Time  // Endpoints of connected peers kept out of the tunnel, with when they were last connected
+	resolved  map[netip.Addr]struct{}   // Addresses of the configured peer endpoints kept out of the tunnel
+	peersSlot int64                     // Our slot on the core's PeersChangedSignal, if connected
+	sysctls   map[string]string         // Kernel settings changed in exit server mode, with their old values
+	ruleset   string                    // The masquerade rules installed in exit server mode
+	killRules string                    // The kill switch rules installed while there is an exit route
 	config    struct {
-		name InterfaceName
-		mtu  InterfaceMTU
+		name       InterfaceName
+		mtu        InterfaceMTU
+		table      RouteTable
+		metric     RouteMetric
+		protocol   RouteProtocol
+		rules      []RoutingRule
+		exitClient bool
+		endpoints  []string
+		exitServer bool
+		killSwitch bool
+		allow      []netip.Prefix
 	}
 }
 
@@ -70,6 +92,12 @@ func (tun *TunAdapter) MTU() uint64 {
 	return getSupportedMTU(tun.mtu)
 }
 
+// Errors returns the number of reads from and writes to the TUN interface
+// which have failed.
+func (tun *TunAdapter) Errors() (read, write uint64) {
+	return atomic.LoadUint64(&tun.readErrs), atomic.LoadUint64(&tun.writeErrs)
+}
+
 // DefaultName gets the default TUN interface name for your platform.
 func DefaultName() string {
 	return defaults.GetDefaults().DefaultIfName
@@ -108,6 +136,10 @@ func (tun *TunAdapter) _start() error {
 	}
 	tun.addr = tun.rwc.Address()
 	tun.subnet = tun.rwc.Subnet()
+	tun.routes = make(map[netip.Prefix]struct{})
+	tun.done = make(chan struct{})
+	tun.endpoints = make(map[netip.Addr]time.Time)
+	tun.resolved = make(map[netip.Addr]struct{})
 	addr := fmt.Sprintf("%s/%d", net.IP(tun.addr[:]).String(), 8*len(tun.core.GetPrefix())-1)
 	if tun.config.name == "none" || tun.config.name == "dummy" {
 		tun.log.Debugln("Not starting TUN as ifname is none or dummy")
@@ -128,6 +160,21 @@ func (tun *TunAdapter) _start() error {
 	tun.rwc.SetMTU(tun.MTU())
 	tun.isOpen = true
 	tun.isEnabled = true
+	tun.rwc.SetRoutesChangedHandler(func() {
+		tun.Act(nil, tun._updateRoutes)
+	})
+	if tun.config.exitClient || tun.config.killSwitch {
+		done := tun.done
+		tun.peersSlot = tun.core.PeersChangedSignal.Connect(func(data interface{}) {
+			select {
+			case <-done:
+				// Disconnecting doesn't remove the callback from the signal,
+				// so it is ignored once the adapter has been stopped
+			default:
+				tun.Act(nil, tun._updateRoutes)
+			}
+		})
+	}
 	go tun.read()
 	go tun.write()
 	return nil
@@ -154,8 +201,17 @@ func (tun *TunAdapter) Stop() error {
 
 func (tun *TunAdapter) _stop() error {
 	tun.isOpen = false
+	tun.rwc.SetRoutesChangedHandler(nil)
+	if tun.config.exitClient || tun.config.killSwitch {
+		tun.core.PeersChangedSignal.Disconnect(tun.peersSlot)
+	}
+	if tun.done != nil {
+		close(tun.done)
+		tun.done = nil
+	}
 	// by TUN, e.g. readers/writers, sessions
 	if tun.iface != nil {
+		tun._removeRoutes()
 		// Just in case we failed to start up the iface for some reason, this can apparently happen on Windows
 		tun.iface.Close()
 	}
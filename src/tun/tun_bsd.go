@@ -154,3 +154,10 @@ func (tun *TunAdapter) setupAddress(addr string) error {
 
 	return nil
 }
+
+// Routes are not installed into the system routing table on this platform,
+// so there is nothing to do when the CKR routes change.
+func (tun *TunAdapter) _updateRoutes() {}
+
+// There are no routes of ours to remove on this platform.
+func (tun *TunAdapter) _removeRoutes() {}
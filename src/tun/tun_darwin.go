@@ -199,3 +199,10 @@ func ioctl(fd int, request int, argp uintptr) error {
 	_, _, errorp := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(request), argp)
 	return errorp
 }
+
+// Routes are not installed into the system routing table on this platform,
+// so there is nothing to do when the CKR routes change.
+func (tun *TunAdapter) _updateRoutes() {}
+
+// There are no routes of ours to remove on this platform.
+func (tun *TunAdapter) _removeRoutes() {}
@@ -6,12 +6,29 @@ package tun
 // The linux platform specific tun parts
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	wgtun "golang.zx2c4.com/wireguard/tun"
 )
 
+// The default protocol ID of the routes that we install, so that they can be
+// told apart from other routes on the TUN link even after a restart.
+const defaultRouteProtocol = 82
+
+// The default priority of the policy routing rules that we install, so that
+// copies left behind by an earlier run can be told apart from rules added by
+// hand, which the kernel would otherwise give the same priority.
+const defaultRulePriority = 5282
+
+// The most copies of a rule left behind by earlier runs that are deleted
+// before it is installed.
+const maxStaleRules = 16
+
 // Configures the TUN adapter with the correct IPv6 address and MTU.
 func (tun *TunAdapter) setup(ifname string, addr string, mtu uint64) error {
 	if ifname == "auto" {
@@ -31,18 +48,21 @@ func (tun *TunAdapter) setup(ifname string, addr string, mtu uint64) error {
 		return err
 	}
 
-	if link, err := netlink.LinkByName(tun.Name()); err != nil {
+	link, err := netlink.LinkByName(tun.Name())
+	if err != nil {
+		return err
+	}
+	if tun.config.exitClient || tun.config.killSwitch {
+		tun.resolved = tun.resolveEndpoints()
+		go tun.watchEndpoints(tun.done)
+	}
+	tun.reconcileRoutes(link)
+	if err := tun.setupRules(); err != nil {
 		return err
-	} else {
-		v4err := tun.setupV4Routes(link)
-		v6err := tun.setupV6Routes(link)
-		if v4err != nil {
-			return v4err
-		}
-		if v6err != nil {
-			return v6err
-		}
 	}
+	tun.updateNAT()
+	tun.updateKillSwitch(link)
+	go tun.watchLink(link.Attrs().Index, tun.done)
 	return nil
 }
 
@@ -86,34 +106,304 @@ func (tun *TunAdapter) setupAddress(addr string) error {
 	return nil
 }
 
-func (tun *TunAdapter) setupV4Routes(link netlink.Link) error {
-	for _, r := range tun.rwc.V4Routes() {
-		route := &netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Dst: &net.IPNet{
-				IP:   net.IP(r.Prefix.Addr().AsSlice()),
-				Mask: net.CIDRMask(r.Prefix.Masked().Bits(), 32),
-			},
+// Brings the routes on the TUN adapter in line with the current CKR routes,
+// if the adapter is open.
+func (tun *TunAdapter) _updateRoutes() {
+	if !tun.isOpen {
+		return
+	}
+	link, err := netlink.LinkByName(tun.Name())
+	if err != nil {
+		tun.log.Errorln("Unable to update routes:", err)
+		return
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		tun.reconcileRoutes(link)
+	} else {
+		// Routes can't be added to a link which is down, they are
+		// reconciled when it comes back up
+		tun.log.Debugln("Not updating routes while the TUN link is down")
+	}
+	tun.updateNAT()
+	tun.updateKillSwitch(link)
+}
+
+// Brings the kernel routes on the TUN link in line with the current CKR
+// routes. Our routes are recognised by their protocol ID, so routes left
+// behind by an earlier run are found too: routes for prefixes which are no
+// longer routed are deleted, and routes for new prefixes are added. A route
+// which can't be added doesn't stop the others from being added, and is tried
+// again the next time the routes are reconciled. In exit client mode the host
+// routes for our peers are reconciled too, before any default route is
+// installed and after it has been removed.
+func (tun *TunAdapter) reconcileRoutes(link netlink.Link) {
+	desired := make(map[netip.Prefix]struct{})
+	exiting := false
+	for _, r := range append(tun.rwc.V4Routes(), tun.rwc.V6Routes()...) {
+		for _, prefix := range tun.installedPrefixes(r.Prefix) {
+			desired[prefix] = struct{}{}
+		}
+		exiting = exiting || tun.config.exitClient && r.Prefix.Bits() == 0
+	}
+	if tun.config.exitClient || tun.config.killSwitch {
+		tun.updateEndpoints()
+	}
+	if exiting {
+		tun.reconcileHostRoutes(link, true)
+	}
+	installed := make(map[netip.Prefix]struct{}, len(desired))
+	for _, route := range tun.ownRoutes(link) {
+		prefix := routePrefix(&route)
+		if _, ok := desired[prefix]; ok && route.Priority == int(tun.config.metric) {
+			if _, ok := installed[prefix]; !ok {
+				installed[prefix] = struct{}{}
+				continue
+			}
+		}
+		if err := netlink.RouteDel(&route); err != nil {
+			tun.log.Errorln("Unable to delete route for", prefix, ":", err)
+		}
+	}
+	for prefix := range desired {
+		if _, ok := installed[prefix]; ok {
+			continue
+		}
+		if err := netlink.RouteAdd(tun.netlinkRoute(link, prefix)); err != nil {
+			tun.log.Errorln("Unable to add route for", prefix, ":", err)
+			continue
+		}
+		installed[prefix] = struct{}{}
+	}
+	tun.routes = installed
+	if !exiting {
+		tun.reconcileHostRoutes(link, false)
+	}
+}
+
+// Deletes all of the routes, rules and nftables tables that we installed.
+func (tun *TunAdapter) _removeRoutes() {
+	tun.removeKillSwitch()
+	tun.removeNAT()
+	tun.removeRules()
+	link, err := netlink.LinkByName(tun.Name())
+	if err != nil {
+		return // The link has gone already, and its routes with it
+	}
+	for _, route := range tun.ownRoutes(link) {
+		if err := netlink.RouteDel(&route); err != nil {
+			tun.log.Errorln("Unable to delete route for", routePrefix(&route), ":", err)
+		}
+	}
+	tun.reconcileHostRoutes(link, false)
+	tun.routes = make(map[netip.Prefix]struct{})
+}
+
+// Returns the kernel routes on the TUN link in our routing table which carry
+// our protocol ID.
+func (tun *TunAdapter) ownRoutes(link netlink.Link) []netlink.Route {
+	filter := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Protocol:  tun.routeProtocol(),
+		Table:     tun.routeTable(),
+	}
+	var routes []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rs, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			tun.log.Errorln("Unable to list routes:", err)
+			continue
 		}
-		if err := netlink.RouteAdd(route); err != nil {
-			return err
+		for _, route := range rs {
+			setDefaultDst(&route, family)
+			routes = append(routes, route)
 		}
 	}
-	return nil
+	return routes
+}
+
+// Reconciles the routes whenever the TUN link comes back up, as the kernel
+// drops the routes on a link when it goes down, whenever one of our routes is
+// deleted by someone else and, in exit client mode or with the kill switch,
+// whenever the default route changes. Runs until done is closed.
+func (tun *TunAdapter) watchLink(index int, done chan struct{}) {
+	links := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		tun.log.Warnln("Unable to watch the TUN link, routes won't be restored if it goes down:", err)
+		links = nil
+	}
+	routes := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribe(routes, done); err != nil {
+		tun.log.Warnln("Unable to watch the routing table, routes won't be restored if they are deleted:", err)
+		routes = nil
+	}
+	up := true
+	for links != nil || routes != nil {
+		select {
+		case update, ok := <-links:
+			if !ok {
+				links = nil
+				continue
+			}
+			if int(update.Index) != index {
+				continue
+			}
+			isUp := update.Flags&unix.IFF_UP != 0
+			if isUp && !up {
+				tun.Act(nil, tun._updateRoutes)
+			}
+			up = isUp
+		case update, ok := <-routes:
+			if !ok {
+				routes = nil
+				continue
+			}
+			if !up {
+				// The kernel deletes the routes on the link when it goes
+				// down, and they are all reconciled when it comes back up
+				continue
+			}
+			switch {
+			case update.Type == unix.RTM_DELROUTE && update.LinkIndex == index &&
+				update.Protocol == tun.routeProtocol() && update.Table == tun.routeTable():
+				tun.Act(nil, tun._updateRoutes)
+			case (tun.config.exitClient || tun.config.killSwitch) && update.Dst == nil && update.LinkIndex != index &&
+				update.Protocol != tun.routeProtocol() && update.Table == unix.RT_TABLE_MAIN:
+				// The default gateway changed, so the host routes must follow it
+				tun.Act(nil, tun._updateRoutes)
+			}
+		}
+	}
+}
+
+// Returns a netlink route for the given prefix through the TUN adapter.
+func (tun *TunAdapter) netlinkRoute(link netlink.Link, prefix netip.Prefix) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       prefixIPNet(prefix),
+		Protocol:  tun.routeProtocol(),
+		Priority:  int(tun.config.metric),
+		Table:     tun.routeTable(),
+	}
+}
+
+// Returns the routing table that our routes are installed into.
+func (tun *TunAdapter) routeTable() int {
+	if tun.config.table > 0 {
+		return int(tun.config.table)
+	}
+	return unix.RT_TABLE_MAIN
 }
 
-func (tun *TunAdapter) setupV6Routes(link netlink.Link) error {
-	for _, r := range tun.rwc.V6Routes() {
-		route := &netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Dst: &net.IPNet{
-				IP:   net.IP(r.Prefix.Addr().AsSlice()),
-				Mask: net.CIDRMask(r.Prefix.Masked().Bits(), 128),
-			},
+// Returns the protocol ID that our routes are installed with.
+func (tun *TunAdapter) routeProtocol() int {
+	if tun.config.protocol > 0 {
+		return int(tun.config.protocol)
+	}
+	return defaultRouteProtocol
+}
+
+// Installs the policy routing rules which send traffic to our routing table.
+// Copies of the rules left behind by an earlier run are replaced. Only rules
+// with the same priority, table and selectors are deleted, which are ours.
+func (tun *TunAdapter) setupRules() error {
+	if err := tun.checkRules(); err != nil {
+		return err
+	}
+	for _, rule := range tun.netlinkRules() {
+		for i := 0; i < maxStaleRules && netlink.RuleDel(rule) == nil; i++ {
 		}
-		if err := netlink.RouteAdd(route); err != nil {
-			return err
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("Error adding routing rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// Checks that the configured routing rules can be installed.
+func (tun *TunAdapter) checkRules() error {
+	if len(tun.config.rules) > 0 && tun.config.table <= 0 {
+		return errors.New("routing rules need a routing table to be set")
+	}
+	for _, r := range tun.config.rules {
+		if r.Mark == 0 && !r.Source.IsValid() {
+			return errors.New("routing rules must match a mark or a source prefix")
 		}
 	}
 	return nil
 }
+
+// Deletes the policy routing rules that we installed.
+func (tun *TunAdapter) removeRules() {
+	for _, rule := range tun.netlinkRules() {
+		if err := netlink.RuleDel(rule); err != nil {
+			tun.log.Errorln("Unable to delete routing rule:", err)
+		}
+	}
+}
+
+// Returns the netlink rules for the configured routing rules. Rules which
+// only match on the fwmark are installed for both IPv4 and IPv6.
+func (tun *TunAdapter) netlinkRules() []*netlink.Rule {
+	var rules []*netlink.Rule
+	for _, r := range tun.config.rules {
+		families := []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+		switch {
+		case r.Source.IsValid() && r.Source.Addr().Is4():
+			families = []int{netlink.FAMILY_V4}
+		case r.Source.IsValid():
+			families = []int{netlink.FAMILY_V6}
+		}
+		for _, family := range families {
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Table = tun.routeTable()
+			if r.Mark != 0 {
+				rule.Mark = int(r.Mark)
+				if r.Mask != 0 {
+					rule.Mask = int(r.Mask)
+				}
+			}
+			if r.Source.IsValid() {
+				rule.Src = prefixIPNet(r.Source)
+			}
+			rule.Priority = defaultRulePriority
+			if r.Priority > 0 {
+				rule.Priority = r.Priority
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Returns the given prefix as a net.IPNet.
+func prefixIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IP(prefix.Masked().Addr().AsSlice()),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+// Fills in the destination of the given kernel route of the given family if
+// it is a default route, as the kernel leaves out the destination of those.
+func setDefaultDst(route *netlink.Route, family int) {
+	if route.Dst != nil {
+		return
+	}
+	route.Dst = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	if family == netlink.FAMILY_V6 {
+		route.Dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+}
+
+// Returns the destination prefix of the given kernel route, which must have
+// its destination filled in by setDefaultDst if it is a default route.
+func routePrefix(route *netlink.Route) netip.Prefix {
+	ip := route.Dst.IP
+	if len(route.Dst.Mask) == net.IPv4len {
+		ip = ip.To4()
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	bits, _ := route.Dst.Mask.Size()
+	return netip.PrefixFrom(addr, bits).Masked()
+}
@@ -0,0 +1,94 @@
+//go:build !mobile
+// +build !mobile
+
+package tun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestRoutePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		dst    *net.IPNet
+		family int
+		prefix string
+	}{
+		{&net.IPNet{IP: net.IPv4(10, 1, 2, 3).To4(), Mask: net.CIDRMask(16, 32)}, netlink.FAMILY_V4, "10.1.0.0/16"},
+		{&net.IPNet{IP: net.IPv4(10, 1, 2, 3), Mask: net.CIDRMask(24, 32)}, netlink.FAMILY_V4, "10.1.2.0/24"},
+		{&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(32, 128)}, netlink.FAMILY_V6, "2001:db8::/32"},
+		{&net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, netlink.FAMILY_V4, "0.0.0.0/0"},
+		{nil, netlink.FAMILY_V4, "0.0.0.0/0"},
+		{nil, netlink.FAMILY_V6, "::/0"},
+	} {
+		route := netlink.Route{Dst: tc.dst}
+		setDefaultDst(&route, tc.family)
+		if got := routePrefix(&route); got != netip.MustParsePrefix(tc.prefix) {
+			t.Errorf("Route to %v: got %s, expected %s", tc.dst, got, tc.prefix)
+		}
+	}
+
+	// Prefixes survive the round trip to a netlink route
+	for _, s := range []string{"10.1.0.0/16", "0.0.0.0/0", "2001:db8::/32", "::/0"} {
+		prefix := netip.MustParsePrefix(s)
+		if got := routePrefix(&netlink.Route{Dst: prefixIPNet(prefix)}); got != prefix {
+			t.Errorf("Got %s, expected %s", got, prefix)
+		}
+	}
+}
+
+func TestNetlinkRules(t *testing.T) {
+	tun := &TunAdapter{}
+	tun.config.table = 100
+	tun.config.rules = []RoutingRule{
+		{Source: netip.MustParsePrefix("192.168.1.0/24"), Priority: 1000},
+		{Source: netip.MustParsePrefix("2001:db8::/32"), Mark: 1},
+		{Mark: 51820, Mask: 0xffff},
+	}
+	if err := tun.checkRules(); err != nil {
+		t.Fatal(err)
+	}
+	rules := tun.netlinkRules()
+	if len(rules) != 4 {
+		t.Fatalf("Got %d rules, expected 4", len(rules))
+	}
+	for i, expected := range []struct {
+		family   int
+		src      string
+		mark     int
+		mask     int
+		priority int
+	}{
+		{netlink.FAMILY_V4, "192.168.1.0/24", -1, -1, 1000},
+		{netlink.FAMILY_V6, "2001:db8::/32", 1, -1, defaultRulePriority},
+		{netlink.FAMILY_V4, "", 51820, 0xffff, defaultRulePriority},
+		{netlink.FAMILY_V6, "", 51820, 0xffff, defaultRulePriority},
+	} {
+		rule := rules[i]
+		if rule.Family != expected.family || rule.Table != 100 || rule.Priority != expected.priority {
+			t.Errorf("Rule %d: unexpected rule %+v", i, rule)
+		}
+		if rule.Mark != expected.mark || rule.Mask != expected.mask {
+			t.Errorf("Rule %d: got mark %d/%x, expected %d/%x", i, rule.Mark, rule.Mask, expected.mark, expected.mask)
+		}
+		switch {
+		case expected.src == "" && rule.Src != nil:
+			t.Errorf("Rule %d: unexpected source %s", i, rule.Src)
+		case expected.src != "" && (rule.Src == nil || rule.Src.String() != expected.src):
+			t.Errorf("Rule %d: got source %s, expected %s", i, rule.Src, expected.src)
+		}
+	}
+
+	tun.config.rules = append(tun.config.rules, RoutingRule{Priority: 1})
+	if err := tun.checkRules(); err == nil {
+		t.Error("Expected a rule without a mark or source to be rejected")
+	}
+	tun.config.rules = tun.config.rules[:1]
+	tun.config.table = 0
+	if err := tun.checkRules(); err == nil {
+		t.Error("Expected rules without a routing table to be rejected")
+	}
+}
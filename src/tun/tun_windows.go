@@ -171,6 +171,7 @@ func (tun *TunAdapter) setupV4Routes() error {
 			}
 			tun.log.Infoln("Added nexthop address:", ip.String())
 			luid.AddRoute(r.Prefix, ip, 1)
+			tun.routes[r.Prefix] = struct{}{}
 		}
 	} else {
 		return errors.New("unable to get native TUN")
@@ -188,6 +189,7 @@ func (tun *TunAdapter) setupV6Routes() error {
 			}
 			tun.log.Infoln("Added nexthop address:", ip.String())
 			luid.AddRoute(r.Prefix, ip, 1)
+			tun.routes[r.Prefix] = struct{}{}
 		}
 	} else {
 		return errors.New("unable to get native TUN")
@@ -195,6 +197,56 @@ func (tun *TunAdapter) setupV6Routes() error {
 	return nil
 }
 
+// Brings the routes on the TUN adapter in line with the current CKR routes,
+// deleting routes for prefixes which have been removed and adding routes for
+// prefixes which are new.
+func (tun *TunAdapter) _updateRoutes() {
+	if !tun.isOpen {
+		return
+	}
+	intf, ok := tun.iface.(*wgtun.NativeTun)
+	if !ok {
+		tun.log.Errorln("Unable to update routes: unable to get native TUN")
+		return
+	}
+	luid := winipcfg.LUID(intf.LUID())
+	ip, ok := netip.AddrFromSlice(tun.addr[:])
+	if !ok {
+		tun.log.Errorln("Unable to update routes: invalid tun address TUN")
+		return
+	}
+	desired := make(map[netip.Prefix]struct{})
+	for _, r := range tun.rwc.V4Routes() {
+		desired[r.Prefix] = struct{}{}
+	}
+	for _, r := range tun.rwc.V6Routes() {
+		desired[r.Prefix] = struct{}{}
+	}
+	for prefix := range tun.routes {
+		if _, ok := desired[prefix]; ok {
+			continue
+		}
+		if err := luid.DeleteRoute(prefix, ip); err != nil {
+			tun.log.Errorln("Unable to delete route for", prefix, ":", err)
+		}
+		delete(tun.routes, prefix)
+	}
+	for prefix := range desired {
+		if _, ok := tun.routes[prefix]; ok {
+			continue
+		}
+		if err := luid.AddRoute(prefix, ip, 1); err != nil {
+			tun.log.Errorln("Unable to add route for", prefix, ":", err)
+			continue
+		}
+		tun.routes[prefix] = struct{}{}
+	}
+}
+
+// The routes on the adapter are removed along with the adapter when it is
+// closed, so there is nothing else to clean up.
+func (tun *TunAdapter) _removeRoutes() {}
+
 /*
  * cleanupAddressesOnDisconnectedInterfaces
  * SPDX-License-Identifier: MIT